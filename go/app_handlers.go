@@ -32,13 +32,12 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.Username == "" || req.FirstName == "" || req.LastName == "" || req.DateOfBirth == "" {
-		writeError(w, http.StatusBadRequest, errors.New("required fields(username, firstname, lastname, date_of_birth) are empty"))
+	if err := validateUserProfile(req.Username, req.FirstName, req.LastName, req.DateOfBirth); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
 	userID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
 	invitationCode := secureRandomStr(15)
 
 	tx, err := database().Beginx()
@@ -48,10 +47,17 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	accessToken, err := createSession(ctx, tx, r, sessionKindApp, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// access_token には最初のセッションのトークンのハッシュだけを残す
 	_, err = tx.ExecContext(
 		ctx,
 		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, accessToken, invitationCode,
+		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, hashSessionToken(accessToken), invitationCode,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -132,11 +138,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "app_session",
-		Value: accessToken,
-	})
+	setSessionCookie(w, sessionKindApp, accessToken)
 
 	writeJSON(w, http.StatusCreated, &appPostUsersResponse{
 		ID:             userID,
@@ -178,17 +180,40 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 
 type getAppRidesResponse struct {
 	Rides []getAppRidesResponseItem `json:"rides"`
+	// 続きがあるときだけ返す。次のページは cursor に指定して取得する
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type getAppRidesResponseItem struct {
 	ID                    string                       `json:"id"`
 	PickupCoordinate      Coordinate                   `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
+	Status                string                       `json:"status"`
 	Chair                 getAppRidesResponseItemChair `json:"chair"`
 	Fare                  int                          `json:"fare"`
 	Evaluation            int                          `json:"evaluation"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
+	Metrics               appRideMetrics               `json:"metrics"`
+	Legs                  []rideLegResponse            `json:"legs"`
+}
+
+type appRideMetrics struct {
+	PickupDistance   int   `json:"pickup_distance"`
+	CarryingDistance int   `json:"carrying_distance"`
+	WaitTimeMs       int64 `json:"wait_time_ms"`
+	PickupTimeMs     int64 `json:"pickup_time_ms"`
+	TripTimeMs       int64 `json:"trip_time_ms"`
+}
+
+func newAppRideMetrics(metrics *RideMetrics) appRideMetrics {
+	return appRideMetrics{
+		PickupDistance:   metrics.PickupDistance,
+		CarryingDistance: metrics.CarryingDistance,
+		WaitTimeMs:       metrics.WaitTimeMs,
+		PickupTimeMs:     metrics.PickupTimeMs,
+		TripTimeMs:       metrics.TripTimeMs,
+	}
 }
 
 type getAppRidesResponseItemChair struct {
@@ -216,69 +241,47 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	}
 	defer ridesTx.Rollback()
 
-	rides := []Ride{}
-	if err := ridesTx.SelectContext(
-		ctx,
-		&rides,
-		`SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC`,
-		user.ID,
-	); err != nil {
+	history, nextCursor, err := getUserRideHistory(ctx, ridesTx, r, user.ID)
+	if err != nil {
+		if errors.Is(err, errBadQuery) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rides := make([]Ride, 0, len(history))
+	for _, h := range history {
+		rides = append(rides, h.Ride)
+	}
+	details, err := loadRideHistoryDetails(ctx, tx, ridesTx, rides)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	items := []getAppRidesResponseItem{}
-	for _, ride := range rides {
-		status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" {
-			continue
-		}
-
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
+	for _, h := range history {
+		ride := h.Ride
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
 			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
 			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
-			Evaluation:            *ride.Evaluation,
+			Status:                h.LatestStatus,
+			Fare:                  fareWithCoupon(quoteForRide(ride), details.couponDiscounts[ride.ID]),
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
+			Metrics:               newAppRideMetrics(details.rideMetrics(ride.ID)),
+			Legs:                  newRideLegResponses(ride, details.stops[ride.ID], details.arrivedAt(ride.ID)),
 		}
-
-		item.Chair = getAppRidesResponseItemChair{}
-
-		chair := &Chair{}
-		if err := ridesTx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		if ride.Evaluation != nil {
+			item.Evaluation = *ride.Evaluation
 		}
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
-
-		// owner := &Owner{}
-		// if err := tx.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
-		// 	writeError(w, http.StatusInternalServerError, err)
-		// 	return
-		// }
-
-		owner, err := ownerByIDCache.Get(ctx, chair.OwnerID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		if h.LatestStatus == "COMPLETED" {
+			item.CompletedAt = ride.UpdatedAt.UnixMilli()
+		}
+		if chair := details.chair(ride); chair != nil {
+			item.Chair = *chair
 		}
-
-		item.Chair.Owner = owner.Name
-
 		items = append(items, item)
 	}
 
@@ -293,13 +296,22 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, &getAppRidesResponse{
-		Rides: items,
+		Rides:      items,
+		NextCursor: nextCursor,
 	})
 }
 
 type appPostRidesRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	Stops                 []Coordinate `json:"stops"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	// 相乗りを許可すると距離料金が割り引かれる
+	Pooled bool `json:"pooled"`
+	// ティアかモデルのどちらかで椅子を希望できる
+	Tier   string   `json:"tier"`
+	Models []string `json:"models"`
+	// 希望の椅子が見つからないまま待ったときに、ほかのティアの椅子を割り当ててよいか
+	AllowTierFallback bool `json:"allow_tier_fallback"`
 }
 
 type appPostRidesResponse struct {
@@ -336,6 +348,31 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateRideStops(req.Stops); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pooled && len(req.Stops) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("pooled rides cannot have stops"))
+		return
+	}
+	tier, err := resolveRideTier(ctx, req.Tier, req.Models)
+	if err != nil {
+		if errors.Is(err, errInvalidTierPreference) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := validateRideCoordinates(ctx, append([]Coordinate{*req.PickupCoordinate, *req.DestinationCoordinate}, req.Stops...)...); err != nil {
+		if errors.Is(err, errOutOfServiceArea) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
@@ -347,6 +384,15 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	if err := lockActiveUser(ctx, tx, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("user not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	ridesTx, err := ridesDatabase().Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -376,21 +422,34 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 経由地があるときだけ経路全体の距離を持たせる
+	var routeDistance *int
+	if len(req.Stops) > 0 {
+		d := calculateRouteDistance(*req.PickupCoordinate, req.Stops, *req.DestinationCoordinate)
+		routeDistance = &d
+	}
+
 	if _, err := ridesTx.ExecContext(
 		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, route_distance, pooled, tier, allow_tier_fallback)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, routeDistance, req.Pooled, sql.NullString{String: tier, Valid: tier != ""}, req.AllowTierFallback,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if _, err := ridesTx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
-	); err != nil {
+	if err := insertRideRequestedModels(ctx, ridesTx, rideID, req.Models); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := insertRideStops(ctx, ridesTx, rideID, req.Stops); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := insertRideStatus(ctx, ridesTx, rideID, "MATCHING"); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -461,17 +520,18 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, quoteForRide(ride))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := tx.Commit(); err != nil {
+	// 利用者の行のロックを放す前にライドを見えるようにして、退会の確認に漏れないようにする
+	if err := ridesTx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if err := ridesTx.Commit(); err != nil {
+	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -483,13 +543,26 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 }
 
 type appPostRidesEstimatedFareRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	Stops                 []Coordinate `json:"stops"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	// 相乗りを許可すると距離料金が割り引かれる
+	Pooled bool `json:"pooled"`
+	// ティアかモデルのどちらかで椅子を希望できる
+	Tier   string   `json:"tier"`
+	Models []string `json:"models"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
-	Fare     int `json:"fare"`
-	Discount int `json:"discount"`
+	Fare     int                                 `json:"fare"`
+	Discount int                                 `json:"discount"`
+	Tiers    []appPostRidesEstimatedFareTierFare `json:"tiers"`
+}
+
+type appPostRidesEstimatedFareTierFare struct {
+	Tier     string `json:"tier"`
+	Fare     int    `json:"fare"`
+	Discount int    `json:"discount"`
 }
 
 func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -503,6 +576,31 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateRideStops(req.Stops); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pooled && len(req.Stops) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("pooled rides cannot have stops"))
+		return
+	}
+	tier, err := resolveRideTier(ctx, req.Tier, req.Models)
+	if err != nil {
+		if errors.Is(err, errInvalidTierPreference) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := validateRideCoordinates(ctx, append([]Coordinate{*req.PickupCoordinate, *req.DestinationCoordinate}, req.Stops...)...); err != nil {
+		if errors.Is(err, errOutOfServiceArea) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	user := ctx.Value("user").(*User)
 
@@ -513,12 +611,34 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	quote := fareQuote{
+		Distance: calculateRouteDistance(*req.PickupCoordinate, req.Stops, *req.DestinationCoordinate),
+		Pooled:   req.Pooled,
+		Tier:     tier,
+	}
+	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, quote)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	// ティアごとの料金も返す
+	tierFares := []appPostRidesEstimatedFareTierFare{}
+	for _, t := range chairTiers {
+		q := quote
+		q.Tier = t
+		f, err := calculateDiscountedFare(ctx, tx, user.ID, nil, q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		tierFares = append(tierFares, appPostRidesEstimatedFareTierFare{
+			Tier:     t,
+			Fare:     f,
+			Discount: initialFare + meteredFare(q) - f,
+		})
+	}
+
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -526,7 +646,8 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
 		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Discount: initialFare + meteredFare(quote) - discounted,
+		Tiers:    tierFares,
 	})
 }
 
@@ -542,7 +663,9 @@ func abs(a int) int {
 }
 
 type appPostRideEvaluationRequest struct {
-	Evaluation int `json:"evaluation"`
+	Evaluation int      `json:"evaluation"`
+	Comment    string   `json:"comment"`
+	Tags       []string `json:"tags"`
 }
 
 type appPostRideEvaluationResponse struct {
@@ -562,6 +685,10 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
 		return
 	}
+	if err := validateRideReview(req.Comment, req.Tags); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	tx, err := database().Beginx()
 	if err != nil {
@@ -613,11 +740,12 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = ridesTx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
+	if err := insertRideStatus(ctx, ridesTx, rideID, "COMPLETED"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := insertRideReview(ctx, ridesTx, ride, req.Comment, req.Tags); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -631,6 +759,27 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	metrics, err := finalizeRideMetrics(ctx, ridesTx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := recordChairSale(ctx, ridesTx, ride, metrics); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := recordChairStats(ctx, ridesTx, ride); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := applyPendingChairDeactivation(ctx, ridesTx, ride.ChairID.String); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	// paymentToken := &PaymentToken{}
 	// if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
 	// 	if errors.Is(err, sql.ErrNoRows) {
@@ -651,7 +800,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, quoteForRide(*ride))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -660,6 +809,11 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		Amount: fare,
 	}
 
+	if err := insertRidePayment(ctx, ridesTx, ride.ID, fare); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	// var paymentGatewayURL string
 	// if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
 	// 	writeError(w, http.StatusInternalServerError, err)
@@ -696,12 +850,49 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	chairStatsCache.Forget(ride.ChairID.String)
 
 	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
 		CompletedAt: ride.UpdatedAt.UnixMilli(),
 	})
 }
 
+type getRideTraceResponse struct {
+	RideID   string             `json:"ride_id"`
+	Segments []rideTraceSegment `json:"segments"`
+}
+
+func appGetRideTrace(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	rideID := r.PathValue("ride_id")
+
+	ride := &Ride{}
+	if err := ridesDatabase().GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	segments, err := getRideTraceSegments(ctx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &getRideTraceResponse{
+		RideID:   ride.ID,
+		Segments: segments,
+	})
+}
+
 type appGetNotificationResponse struct {
 	Data         *appGetNotificationResponseData `json:"data"`
 	RetryAfterMs int                             `json:"retry_after_ms"`
@@ -714,20 +905,34 @@ type appGetNotificationResponseData struct {
 	Fare                  int                              `json:"fare"`
 	Status                string                           `json:"status"`
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
+	ETA                   *appGetNotificationResponseETA   `json:"eta,omitempty"`
+	Pool                  *appGetNotificationResponsePool  `json:"pool,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
 }
 
+// 相乗りを選んだライドのみ返す
+type appGetNotificationResponsePool struct {
+	// ほかの乗客と同じ椅子に乗り合わせているか
+	Shared bool `json:"shared"`
+	// 同じ椅子に割り当てられているほかの乗客の数
+	CoRiderCount    int `json:"co_rider_count"`
+	DiscountPercent int `json:"discount_percent"`
+}
+
 type appGetNotificationResponseChair struct {
 	ID    string                               `json:"id"`
 	Name  string                               `json:"name"`
 	Model string                               `json:"model"`
+	State string                               `json:"state"`
 	Stats appGetNotificationResponseChairStats `json:"stats"`
 }
 
 type appGetNotificationResponseChairStats struct {
 	TotalRidesCount    int     `json:"total_rides_count"`
 	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
+	// レビューに付けられたタグごとの件数
+	TagCounts map[string]int `json:"tag_counts"`
 }
 
 func appGetNotification(w http.ResponseWriter, r *http.Request) {
@@ -777,7 +982,7 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		status = yetSentRideStatus.Status
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, quoteForRide(*ride))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -819,8 +1024,43 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 			ID:    chair.ID,
 			Name:  chair.Name,
 			Model: chair.Model,
+			State: chairState(chair.IsActive, chair.PendingDeactivation),
 			Stats: stats,
 		}
+
+		// 経由地の無いライドは route_distance を持たないので、ride_stops を引かなくてよい
+		stops := []RideStop{}
+		if ride.RouteDistance != nil {
+			stops, err = getRideStops(ctx, ridesTx, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		eta, err := estimateRideETA(ctx, ride, status, chair, stops)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		response.Data.ETA = eta
+	}
+
+	if ride.Pooled {
+		pool := &appGetNotificationResponsePool{DiscountPercent: pooledDiscountPercent}
+		if ride.ChairID.Valid {
+			activeRides, err := getChairActiveRides(ctx, ridesTx, ride.ChairID.String)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			for _, r := range activeRides {
+				if r.ID != ride.ID {
+					pool.CoRiderCount++
+				}
+			}
+			pool.Shared = pool.CoRiderCount > 0
+		}
+		response.Data.Pool = pool
 	}
 
 	if yetSentRideStatus.ID != "" {
@@ -845,77 +1085,22 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, response)
 }
 
+// 完了時に加算している chair_stats から返す
 func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
 	stats := appGetNotificationResponseChairStats{}
 
-	type RideWithStatuses struct {
-		RideID     string    `db:"ride_id"`
-		ChairID    string    `db:"chair_id"`
-		Evaluation *int      `db:"evaluation"`
-		Status     string    `db:"status"`
-		CreatedAt  time.Time `db:"created_at"`
-	}
-	rideWithStatuses := []RideWithStatuses{}
-	err := tx.SelectContext(
-		ctx,
-		&rideWithStatuses,
-		`SELECT 
-			r.id AS ride_id, 
-			r.chair_id, 
-			r.evaluation, 
-			rs.status, 
-			rs.created_at
-		FROM rides r
-		INNER JOIN ride_statuses rs ON r.id = rs.ride_id
-		WHERE r.chair_id = ?
-		ORDER BY r.updated_at DESC, rs.created_at
-		`,
-		chairID,
-	)
+	chairStats, err := chairStatsCache.Get(ctx, chairID)
 	if err != nil {
 		return stats, err
 	}
+	stats.TotalRidesCount = chairStats.RideCount
+	stats.TotalEvaluationAvg = chairStats.evaluationAvg()
 
-	// 統計用
-	totalRideCount := 0
-	totalEvaluation := 0.0
-
-	// ライドごとに処理
-	rideMap := make(map[string][]RideWithStatuses)
-	for _, row := range rideWithStatuses {
-		rideMap[row.RideID] = append(rideMap[row.RideID], row)
-	}
-
-	for _, rideStatuses := range rideMap {
-		var arrivedAt, pickupedAt *time.Time
-		var isCompleted bool
-		var evaluation *int
-
-		for _, status := range rideStatuses {
-			if status.Status == "ARRIVED" {
-				arrivedAt = &status.CreatedAt
-			} else if status.Status == "CARRYING" {
-				pickupedAt = &status.CreatedAt
-			}
-			if status.Status == "COMPLETED" {
-				isCompleted = true
-			}
-			evaluation = status.Evaluation
-		}
-
-		// 条件を満たさない場合はスキップ
-		if arrivedAt == nil || pickupedAt == nil || !isCompleted || evaluation == nil {
-			continue
-		}
-
-		totalRideCount++
-		totalEvaluation += float64(*evaluation)
-	}
-
-	stats.TotalRidesCount = totalRideCount
-	if totalRideCount > 0 {
-		stats.TotalEvaluationAvg = totalEvaluation / float64(totalRideCount)
+	tagCounts, err := getChairReviewTagCounts(ctx, tx, chairID)
+	if err != nil {
+		return stats, err
 	}
+	stats.TagCounts = tagCounts
 
 	return stats, nil
 }
@@ -983,7 +1168,7 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	err = ridesTx.SelectContext(
 		ctx,
 		&chairs,
-		`SELECT * FROM chairs WHERE is_active = 1`,
+		`SELECT * FROM chairs WHERE is_active = 1 AND pending_deactivation = 0`,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -1075,18 +1260,15 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 }
 
 func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
+	return fareForDistance(calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude))
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
+// ride があればその条件で、無ければ quote で見積もる
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, quote fareQuote) (int, error) {
 	var coupon Coupon
 	discount := 0
 	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
+		quote = quoteForRide(*ride)
 
 		// すでにクーポンが紐づいているならそれの割引額を参照
 		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
@@ -1116,8 +1298,5 @@ func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ri
 		}
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
+	return fareWithCoupon(quote, discount), nil
 }
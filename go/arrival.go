@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 目的地からこの距離 (マンハッタン距離) 以内に入ったら到着とみなす
+var arrivalRadius = func() int {
+	radius := 0
+	if vStr, exists := os.LookupEnv("ISUCON_ARRIVAL_RADIUS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val >= 0 {
+			radius = val
+		}
+	}
+	return radius
+}()
+
+// ライドの状態は必ずここを通して書き込む
+func insertRideStatus(ctx context.Context, ridesTx *sqlx.Tx, rideID, status string) error {
+	_, err := ridesTx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), rideID, status)
+	return err
+}
+
+// まとめて送られた座標から判定した状態は、その座標の記録時刻で書き込む
+// 最新の状態は created_at の順で決まるので、それより前の時刻にはしない
+func insertRideStatusAt(ctx context.Context, ridesTx *sqlx.Tx, rideID, status string, createdAt time.Time) error {
+	_, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO ride_statuses (id, ride_id, status, created_at)
+			SELECT ?, ?, ?, GREATEST(?, COALESCE(MAX(created_at) + INTERVAL 1 MICROSECOND, ?))
+			FROM ride_statuses WHERE ride_id = ?`,
+		ulid.Make().String(), rideID, status, createdAt, createdAt, rideID,
+	)
+	return err
+}
+
+func isWithinArrivalRadius(point, target Coordinate) bool {
+	return calculateDistance(point.Latitude, point.Longitude, target.Latitude, target.Longitude) <= arrivalRadius
+}
+
+// from から to への移動中に target の到着範囲に入ったかどうか
+// 座標の送信間隔の間に目的地を通り過ぎた場合も到着とみなす
+func hasReachedTarget(from *Coordinate, to, target Coordinate) bool {
+	if isWithinArrivalRadius(to, target) {
+		return true
+	}
+	if from == nil {
+		return false
+	}
+	return segmentDistance(*from, to, target) <= float64(arrivalRadius)
+}
+
+// 線分 a-b 上の点と p とのマンハッタン距離の最小値
+// 距離は線分上で区分線形な凸関数なので、折れ点と端点だけを調べればよい
+func segmentDistance(a, b, p Coordinate) float64 {
+	dLatitude := float64(b.Latitude - a.Latitude)
+	dLongitude := float64(b.Longitude - a.Longitude)
+	candidates := []float64{0, 1}
+	if dLatitude != 0 {
+		candidates = append(candidates, float64(p.Latitude-a.Latitude)/dLatitude)
+	}
+	if dLongitude != 0 {
+		candidates = append(candidates, float64(p.Longitude-a.Longitude)/dLongitude)
+	}
+
+	minDistance := math.Inf(1)
+	for _, t := range candidates {
+		if t < 0 || t > 1 {
+			continue
+		}
+		distance := math.Abs(float64(a.Latitude)+t*dLatitude-float64(p.Latitude)) +
+			math.Abs(float64(a.Longitude)+t*dLongitude-float64(p.Longitude))
+		minDistance = min(minDistance, distance)
+	}
+	return minDistance
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -33,48 +36,69 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// owner := &Owner{}
-	// if err := database().GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
-	// 	if errors.Is(err, sql.ErrNoRows) {
-	// 		writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
-	// 		return
-	// 	}
-	// 	writeError(w, http.StatusInternalServerError, err)
-	// 	return
-	// }
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
 
-	owner, err := ownerByRegisterCache.Get(ctx, req.ChairRegisterToken)
+	// 失効がすぐ反映されるようにキャッシュせずに毎回引く
+	registerToken, err := getUsableChairRegisterTokenForUpdate(ctx, tx, req.ChairRegisterToken)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
+		if errors.Is(err, errUnusableChairRegisterToken) {
+			writeError(w, http.StatusUnauthorized, err)
 			return
 		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if _, err := tx.ExecContext(ctx, "UPDATE chair_register_tokens SET used_count = used_count + 1 WHERE id = ?", registerToken.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	chairID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
+	accessToken, err := createSession(ctx, tx, r, sessionKindChair, chairID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	_, err = ridesDatabase().ExecContext(
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	// access_token には最初のセッションのトークンのハッシュだけを残す
+	_, err = ridesTx.ExecContext(
 		ctx,
-		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
-		chairID, owner.ID, req.Name, req.Model, false, accessToken,
+		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token, register_token_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		chairID, registerToken.OwnerID, req.Name, req.Model, false, hashSessionToken(accessToken), registerToken.ID,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "chair_session",
-		Value: accessToken,
-	})
+	// 使用回数を数えてから椅子を登録する。途中で失敗しても max_uses を超えて登録されることはない
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	setSessionCookie(w, sessionKindChair, accessToken)
 
 	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
 		ID:      chairID,
-		OwnerID: owner.ID,
+		OwnerID: registerToken.OwnerID,
 	})
 }
 
@@ -92,43 +116,98 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := ridesDatabase().ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	ridesTx, err := ridesDatabase().Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer ridesTx.Rollback()
+
+	// 走行中に停止した場合はライドを終えるまで finishing になり、新しいライドは割り当てられない
+	if _, err := setChairActive(ctx, ridesTx, chair.ID, req.IsActive, chairActivityReasonManual); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// 別のインスタンスが記録した位置はキャッシュに反映されていないので、常に DB の最大値を使う
+func lastChairLocationTime(ctx context.Context, tx *sqlx.Tx, chairID string) (sql.NullTime, error) {
+	var lastRecordedAt sql.NullTime
+	if err := tx.GetContext(ctx, &lastRecordedAt, "SELECT MAX(created_at) FROM chair_locations WHERE chair_id = ?", chairID); err != nil {
+		return sql.NullTime{}, err
+	}
+	return lastRecordedAt, nil
+}
+
 type chairPostCoordinateResponse struct {
 	RecordedAt int64 `json:"recorded_at"`
 }
 
-func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	req := &Coordinate{}
-	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+type timedCoordinate struct {
+	Coordinate
+	RecordedAt time.Time
+}
+
+// 座標の記録中に状態を追いかける、椅子に割り当て中のライド
+type chairActiveRide struct {
+	ride   Ride
+	status string
+	stops  []RideStop
+}
+
+// 椅子が from から point まで distance だけ移動したことをライドに反映する
+func (r *chairActiveRide) advance(ctx context.Context, ridesTx *sqlx.Tx, chairID string, from *Coordinate, point timedCoordinate, distance int) error {
+	ride := &r.ride
+	if isTracedRideStatus(r.status) {
+		if err := appendRideTracePoint(ctx, ridesTx, ride.ID, chairID, r.status, point.Latitude, point.Longitude, point.RecordedAt); err != nil {
+			return err
+		}
 	}
 
-	chair := ctx.Value("chairOnlyNoChange").(*ChairOnlyNoChange)
+	if distance > 0 {
+		if err := addRideDistance(ctx, ridesTx, ride.ID, r.status, distance); err != nil {
+			return err
+		}
+	}
 
-	tx, err := database().Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	if r.status == "ENROUTE" && hasReachedTarget(from, point.Coordinate, pickup) {
+		if err := insertRideStatusAt(ctx, ridesTx, ride.ID, "PICKUP", point.RecordedAt); err != nil {
+			return err
+		}
+		r.status = "PICKUP"
 	}
-	defer tx.Rollback()
 
-	ridesTx, err := ridesDatabase().Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	// 経由地は順番に回り、すべて回り終えてから目的地への到着を判定する
+	for stop := nextRideStop(r.stops); r.status == "CARRYING" && stop != nil; stop = nextRideStop(r.stops) {
+		if !hasReachedTarget(from, point.Coordinate, Coordinate{Latitude: stop.Latitude, Longitude: stop.Longitude}) {
+			break
+		}
+		if err := markRideStopArrived(ctx, ridesTx, stop, point.RecordedAt); err != nil {
+			return err
+		}
 	}
-	defer ridesTx.Rollback()
 
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	if r.status == "CARRYING" && nextRideStop(r.stops) == nil && hasReachedTarget(from, point.Coordinate, destination) {
+		if err := insertRideStatusAt(ctx, ridesTx, ride.ID, "ARRIVED", point.RecordedAt); err != nil {
+			return err
+		}
+		r.status = "ARRIVED"
+	}
+	return nil
+}
+
+// 椅子の座標を記録順に反映し、最後の位置を返す
+// 総移動距離、割り当て中のライドの軌跡・移動距離、PICKUP / ARRIVED の判定をまとめて更新する
+func recordChairCoordinates(ctx context.Context, tx *sqlx.Tx, ridesTx *sqlx.Tx, chair *ChairOnlyNoChange, points []timedCoordinate) (*ChairLocation, error) {
 	// 最後の椅子の位置を取得
 	var lastLocation ChairLocation
 	last_err := tx.GetContext(ctx, &lastLocation, `
@@ -139,8 +218,7 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		LIMIT 1
 	`, chair.ID)
 	if last_err != nil && !errors.Is(last_err, sql.ErrNoRows) {
-		writeError(w, http.StatusInternalServerError, last_err)
-		return
+		return nil, last_err
 	}
 
 	var locationID string
@@ -150,7 +228,69 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		locationID = lastLocation.ID
 	}
 
-	new_created_at := time.Now()
+	// 相乗りでは複数のライドを同時に運ぶので、割り当て中のライドすべてを追跡する
+	rides, err := getChairActiveRides(ctx, ridesTx, chair.ID)
+	if err != nil {
+		return nil, err
+	}
+	activeRides := make([]*chairActiveRide, 0, len(rides))
+	for _, ride := range rides {
+		status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
+		if err != nil {
+			return nil, err
+		}
+		stops, err := getRideStops(ctx, ridesTx, ride.ID)
+		if err != nil {
+			return nil, err
+		}
+		activeRides = append(activeRides, &chairActiveRide{ride: ride, status: status, stops: stops})
+	}
+
+	speed, err := chairModelSpeedCache.Get(ctx, chair.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev *Coordinate
+	var prevAt time.Time
+	if last_err == nil {
+		prev = &Coordinate{Latitude: lastLocation.Latitude, Longitude: lastLocation.Longitude}
+		prevAt = lastLocation.CreatedAt
+	}
+	totalDistance := 0
+	suspiciousEvents := []*ChairSuspiciousEvent{}
+	for _, point := range points {
+		// 距離の更新をするように
+		distance := 0
+		if prev != nil {
+			// 両方取得できたときのみ
+			distance = calculateDistance(prev.Latitude, prev.Longitude, point.Latitude, point.Longitude)
+			totalDistance += distance
+			if event := checkChairMovement(chair, speed, *prev, prevAt, point.Coordinate, point.RecordedAt); event != nil {
+				suspiciousEvents = append(suspiciousEvents, event)
+			}
+		}
+		from := prev
+		prev = &Coordinate{Latitude: point.Latitude, Longitude: point.Longitude}
+		prevAt = point.RecordedAt
+
+		for _, ride := range activeRides {
+			if err := ride.advance(ctx, ridesTx, chair.ID, from, point, distance); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(suspiciousEvents) > 0 {
+		if movementCheckMode == movementCheckReject {
+			return nil, &implausibleMovementError{events: suspiciousEvents}
+		}
+		if err := insertChairSuspiciousEvents(ctx, tx, suspiciousEvents); err != nil {
+			return nil, err
+		}
+	}
+
+	last := points[len(points)-1]
 	if _, err := tx.ExecContext(
 		ctx,
 		`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at)
@@ -160,64 +300,160 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
     		latitude = VALUES(latitude),
     		longitude = VALUES(longitude),
     		created_at = VALUES(created_at)`,
-		locationID, chair.ID, req.Latitude, req.Longitude, new_created_at,
+		locationID, chair.ID, last.Latitude, last.Longitude, last.RecordedAt,
 	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 	location := &ChairLocation{
-		ID:        lastLocation.ID,
+		ID:        locationID,
 		ChairID:   chair.ID,
-		Latitude:  req.Latitude,
-		Longitude: req.Longitude,
-		CreatedAt: new_created_at,
+		Latitude:  last.Latitude,
+		Longitude: last.Longitude,
+		CreatedAt: last.RecordedAt,
 	}
 
-	chairLocationsCache.Store(chair.ID, location)
-
-	// 距離の更新をするように
-	var distance int
 	if last_err == nil {
-		// 両方取得できたときのみ
-		distance = abs(location.Latitude-lastLocation.Latitude) + abs(location.Longitude-lastLocation.Longitude)
 		if _, err := ridesTx.ExecContext(ctx, `
 		UPDATE chairs
 		SET total_distance = total_distance + ?, 
 		    total_distance_updated_at = ?
 		WHERE id = ?
-	`, distance, location.CreatedAt, chair.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	`, totalDistance, location.CreatedAt, chair.ID); err != nil {
+			return nil, err
 		}
 	}
 
-	ride := &Ride{}
-	if err := ridesTx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusInternalServerError, err)
+	return location, nil
+}
+
+func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &Coordinate{}
+	if err := bindJSON(r, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	chair := ctx.Value("chairOnlyNoChange").(*ChairOnlyNoChange)
+
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	location, err := recordChairCoordinates(ctx, tx, ridesTx, chair, []timedCoordinate{
+		{Coordinate: *req, RecordedAt: time.Now()},
+	})
+	if err != nil {
+		writeChairCoordinatesError(ctx, w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chairLocationsCache.Store(chair.ID, location)
+	fleetBroker.publish(chair.OwnerID, location)
+
+	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
+		RecordedAt: location.CreatedAt.UnixMilli(),
+	})
+}
+
+const maxChairCoordinatesBatchSize = 1000
+
+type chairPostCoordinatesRequest struct {
+	Coordinates []chairPostCoordinatesRequestCoordinate `json:"coordinates"`
+}
+
+type chairPostCoordinatesRequestCoordinate struct {
+	Latitude  int   `json:"latitude"`
+	Longitude int   `json:"longitude"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// 移動中にバッファした座標をまとめて送るためのエンドポイント
+func chairPostCoordinates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &chairPostCoordinatesRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Coordinates) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("coordinates is empty"))
+		return
+	}
+	if len(req.Coordinates) > maxChairCoordinatesBatchSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("too many coordinates (max %d)", maxChairCoordinatesBatchSize))
+		return
+	}
+
+	chair := ctx.Value("chairOnlyNoChange").(*ChairOnlyNoChange)
+
+	now := time.Now()
+	points := make([]timedCoordinate, 0, len(req.Coordinates))
+	for i, c := range req.Coordinates {
+		recordedAt := time.UnixMilli(c.Timestamp)
+		if recordedAt.After(now) {
+			writeError(w, http.StatusBadRequest, errors.New("timestamp must not be in the future"))
 			return
 		}
-	} else {
-		status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+		if i > 0 && !recordedAt.After(points[i-1].RecordedAt) {
+			writeError(w, http.StatusBadRequest, errors.New("timestamps must be strictly increasing"))
 			return
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := ridesTx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
+		points = append(points, timedCoordinate{
+			Coordinate: Coordinate{Latitude: c.Latitude, Longitude: c.Longitude},
+			RecordedAt: recordedAt,
+		})
+	}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := ridesTx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		}
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 既に記録済みの位置と同時刻か、それより古い座標は受け付けない
+	lastRecordedAt, err := lastChairLocationTime(ctx, tx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if lastRecordedAt.Valid && !points[0].RecordedAt.After(lastRecordedAt.Time) {
+		writeError(w, http.StatusBadRequest, errors.New("coordinates are not newer than the last recorded location"))
+		return
+	}
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	location, err := recordChairCoordinates(ctx, tx, ridesTx, chair, points)
+	if err != nil {
+		writeChairCoordinatesError(ctx, w, err)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -230,6 +466,9 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chairLocationsCache.Store(chair.ID, location)
+	fleetBroker.publish(chair.OwnerID, location)
+
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
 		RecordedAt: location.CreatedAt.UnixMilli(),
 	})
@@ -238,6 +477,9 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 type simpleUser struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
+	// 椅子からの評価の平均。まだ評価されていなければ null
+	Rating      *float64 `json:"rating"`
+	RatingCount int      `json:"rating_count"`
 }
 
 type chairGetNotificationResponse struct {
@@ -246,11 +488,16 @@ type chairGetNotificationResponse struct {
 }
 
 type chairGetNotificationResponseData struct {
-	RideID                string     `json:"ride_id"`
-	User                  simpleUser `json:"user"`
-	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate Coordinate `json:"destination_coordinate"`
-	Status                string     `json:"status"`
+	RideID                string             `json:"ride_id"`
+	User                  simpleUser         `json:"user"`
+	PickupCoordinate      Coordinate         `json:"pickup_coordinate"`
+	Stops                 []rideStopResponse `json:"stops"`
+	DestinationCoordinate Coordinate         `json:"destination_coordinate"`
+	Status                string             `json:"status"`
+	Pooled                bool               `json:"pooled"`
+	PooledRideIDs         []string           `json:"pooled_ride_ids"`
+	// 相乗りで回る順番。迂回の上限はこの順番で回る前提で確かめている
+	PooledRoute []poolWaypoint `json:"pooled_route"`
 }
 
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
@@ -275,15 +522,28 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	yetSentRideStatus := RideStatus{}
 	status := ""
 
-	if err := ridesTx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-				RetryAfterMs: 30,
-			})
+	// 相乗りでは複数のライドの通知が並ぶので、未送信の状態があるライドを先に返す
+	if err := ridesTx.GetContext(ctx, ride, `
+		SELECT rides.* FROM rides
+		JOIN ride_statuses ON ride_statuses.ride_id = rides.id
+		WHERE rides.chair_id = ? AND ride_statuses.chair_sent_at IS NULL
+		ORDER BY ride_statuses.created_at ASC
+		LIMIT 1
+	`, chair.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := ridesTx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+					RetryAfterMs: 30,
+				})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
 	}
 
 	if err := ridesTx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
@@ -312,6 +572,40 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	score, err := riderScoreCache.Get(ctx, ride.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	stops, err := getRideStops(ctx, ridesTx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 同じ椅子で相乗りしているほかのライド
+	pooledRideIDs := []string{}
+	pooledRoute := []poolWaypoint{}
+	if ride.Pooled {
+		activeRides, err := getChairActiveRides(ctx, ridesTx, chair.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, r := range activeRides {
+			if r.ID != ride.ID {
+				pooledRideIDs = append(pooledRideIDs, r.ID)
+			}
+		}
+		if len(pooledRideIDs) > 0 {
+			pooledRoute, err = getChairPoolRoute(ctx, ridesTx, chair.ID, activeRides)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
 
 	if yetSentRideStatus.ID != "" {
 		// latestRideStatusCache.Forget(ride.ID)
@@ -336,13 +630,19 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		Data: &chairGetNotificationResponseData{
 			RideID: ride.ID,
 			User: simpleUser{
-				ID:   user.ID,
-				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+				ID:          user.ID,
+				Name:        fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+				Rating:      score.rating(),
+				RatingCount: score.Count,
 			},
 			PickupCoordinate: Coordinate{
 				Latitude:  ride.PickupLatitude,
 				Longitude: ride.PickupLongitude,
 			},
+			Stops:         newRideStopResponses(stops),
+			Pooled:        ride.Pooled,
+			PooledRideIDs: pooledRideIDs,
+			PooledRoute:   pooledRoute,
 			DestinationCoordinate: Coordinate{
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
@@ -401,7 +701,7 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	switch req.Status {
 	// Acknowledge the ride
 	case "ENROUTE":
-		if _, err := ridesTx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
+		if err := insertRideStatus(ctx, ridesTx, ride.ID, "ENROUTE"); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -416,12 +716,58 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
 			return
 		}
-		if _, err := ridesTx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
+		if err := insertRideStatus(ctx, ridesTx, ride.ID, "CARRYING"); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	// 座標の自動判定で到着にならなかった場合の手動操作
+	case "PICKUP", "ARRIVED":
+		status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		target := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+		expected := "ENROUTE"
+		if req.Status == "ARRIVED" {
+			target = Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+			expected = "CARRYING"
+		}
+		if status != expected {
+			writeError(w, http.StatusBadRequest, errors.New("invalid status transition"))
+			return
+		}
+		if req.Status == "ARRIVED" {
+			stops, err := getRideStops(ctx, ridesTx, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if nextRideStop(stops) != nil {
+				writeError(w, http.StatusBadRequest, errRideStopsRemaining)
+				return
+			}
+		}
+		location, err := getChairLocation(ctx, chair.ID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusBadRequest, errors.New("chair location is unknown"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !isWithinArrivalRadius(Coordinate{Latitude: location.Latitude, Longitude: location.Longitude}, target) {
+			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
+			return
+		}
+		if err := insertRideStatus(ctx, ridesTx, ride.ID, req.Status); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 	default:
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
 	}
 
 	// if err := tx.Commit(); err != nil {
@@ -436,3 +782,85 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// 座標の自動判定で経由地に到着にならなかった場合の手動操作
+// 経由地は順番に回るので、まだ到着していない最初の経由地だけを受け付ける
+func chairPostRideStopArrival(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	chair := ctx.Value("chairOnlyNoChange").(*ChairOnlyNoChange)
+
+	stopIndex, err := strconv.Atoi(r.PathValue("stop_index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid stop_index"))
+		return
+	}
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	ride := &Ride{}
+	if err := ridesTx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.ChairID.String != chair.ID {
+		writeError(w, http.StatusBadRequest, errors.New("not assigned to this ride"))
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != "CARRYING" {
+		writeError(w, http.StatusBadRequest, errors.New("invalid status transition"))
+		return
+	}
+
+	stops, err := getRideStops(ctx, ridesTx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	stop := nextRideStop(stops)
+	if stop == nil || stop.StopIndex != stopIndex {
+		writeError(w, http.StatusBadRequest, errors.New("not the next stop"))
+		return
+	}
+
+	location, err := getChairLocation(ctx, chair.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusBadRequest, errors.New("chair location is unknown"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !isWithinArrivalRadius(Coordinate{Latitude: location.Latitude, Longitude: location.Longitude}, Coordinate{Latitude: stop.Latitude, Longitude: stop.Longitude}) {
+		writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
+		return
+	}
+
+	if err := markRideStopArrived(ctx, ridesTx, stop, time.Now()); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
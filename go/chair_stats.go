@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/motoki317/sc"
+)
+
+type ChairStats struct {
+	ChairID       string    `db:"chair_id"`
+	RideCount     int       `db:"ride_count"`
+	EvaluationSum int       `db:"evaluation_sum"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+func (s *ChairStats) evaluationAvg() float64 {
+	if s.RideCount == 0 {
+		return 0
+	}
+	return float64(s.EvaluationSum) / float64(s.RideCount)
+}
+
+// 完了したライドが無い椅子は行を持たないので、0 件の成績を返す
+var chairStatsCache, _ = sc.New(func(ctx context.Context, chairID string) (*ChairStats, error) {
+	stats := &ChairStats{}
+	if err := ridesDatabase().GetContext(ctx, stats, "SELECT * FROM chair_stats WHERE chair_id = ?", chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ChairStats{ChairID: chairID}, nil
+		}
+		return nil, err
+	}
+	return stats, nil
+}, 90*time.Second, 90*time.Second)
+
+// 評価を受けて完了したライドを椅子の成績に加算する
+// コミット後に chairStatsCache.Forget すること
+func recordChairStats(ctx context.Context, ridesTx *sqlx.Tx, ride *Ride) error {
+	if !ride.ChairID.Valid {
+		return errors.New("ride is not assigned to any chair")
+	}
+	if ride.Evaluation == nil {
+		return nil
+	}
+	_, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO chair_stats (chair_id, ride_count, evaluation_sum) VALUES (?, 1, ?)
+			ON DUPLICATE KEY UPDATE
+				ride_count = ride_count + 1,
+				evaluation_sum = evaluation_sum + VALUES(evaluation_sum)`,
+		ride.ChairID.String, *ride.Evaluation,
+	)
+	return err
+}
+
+// 乗車・到着・完了を経て評価されたライドを rides / ride_statuses から数え直す
+const chairStatsFromRidesQuery = `
+	SELECT rides.chair_id, COUNT(*) AS ride_count, SUM(rides.evaluation) AS evaluation_sum
+	FROM rides
+	WHERE rides.chair_id IS NOT NULL AND rides.evaluation IS NOT NULL
+		AND (SELECT COUNT(DISTINCT status) FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND status IN ('CARRYING', 'ARRIVED', 'COMPLETED')) = 3
+	GROUP BY rides.chair_id`
+
+// 初期データ投入後(postInitialize)と check-chair-stats --fix から呼ばれる
+func rebuildChairStats(ctx context.Context) error {
+	tx, err := ridesDatabase().Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chair_stats`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO chair_stats (chair_id, ride_count, evaluation_sum) `+chairStatsFromRidesQuery); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	chairStatsCache.Purge()
+	return nil
+}
+
+type chairStatsDrift struct {
+	ChairID               string
+	RideCount             int
+	ExpectedRideCount     int
+	EvaluationSum         int
+	ExpectedEvaluationSum int
+}
+
+// chair_stats と数え直した結果が食い違う椅子を返す
+func checkChairStats(ctx context.Context) ([]chairStatsDrift, error) {
+	stored := []ChairStats{}
+	if err := ridesDatabase().SelectContext(ctx, &stored, `SELECT * FROM chair_stats`); err != nil {
+		return nil, err
+	}
+	expected := []ChairStats{}
+	if err := ridesDatabase().SelectContext(ctx, &expected, chairStatsFromRidesQuery); err != nil {
+		return nil, err
+	}
+
+	storedByChair := make(map[string]ChairStats, len(stored))
+	for _, s := range stored {
+		storedByChair[s.ChairID] = s
+	}
+	drifts := []chairStatsDrift{}
+	for _, e := range expected {
+		s := storedByChair[e.ChairID]
+		delete(storedByChair, e.ChairID)
+		if s.RideCount != e.RideCount || s.EvaluationSum != e.EvaluationSum {
+			drifts = append(drifts, chairStatsDrift{
+				ChairID:               e.ChairID,
+				RideCount:             s.RideCount,
+				ExpectedRideCount:     e.RideCount,
+				EvaluationSum:         s.EvaluationSum,
+				ExpectedEvaluationSum: e.EvaluationSum,
+			})
+		}
+	}
+	// 数え直すと 0 件になる椅子
+	for _, s := range storedByChair {
+		if s.RideCount != 0 || s.EvaluationSum != 0 {
+			drifts = append(drifts, chairStatsDrift{
+				ChairID:       s.ChairID,
+				RideCount:     s.RideCount,
+				EvaluationSum: s.EvaluationSum,
+			})
+		}
+	}
+	return drifts, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -68,3 +69,9 @@ func database() *sqlx.DB {
 func ridesDatabase() *sqlx.DB {
 	return dbs[1]
 }
+
+// 一意制約に違反したかどうか。先に確かめていても、同時に書き込まれると起こりうる
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
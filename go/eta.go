@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type appGetNotificationResponseETA struct {
+	// 迎車が済んでいれば省略する
+	PickupInMs      *int64 `json:"pickup_in_ms,omitempty"`
+	DestinationInMs int64  `json:"destination_in_ms"`
+	// 推定に使った椅子の座標の記録日時
+	LocationRecordedAt int64 `json:"location_recorded_at"`
+}
+
+// 距離をモデルの速度で移動したときの所要時間
+func estimateTravelTime(distance, speed int) time.Duration {
+	if speed <= 0 {
+		return 0
+	}
+	moves := (distance + speed - 1) / speed
+	return time.Duration(moves) * chairMoveInterval
+}
+
+// 椅子の最新位置から残りのマンハッタン距離を求めて、迎車・到着までの時間を推定する
+// 座標が届くたびに最新位置が変わるので、通知を取得するたびに計算し直す
+// stops は呼び出し側で読み込んだライドの経由地
+// 推定できない状態や椅子の位置が分からない場合は nil を返す
+func estimateRideETA(ctx context.Context, ride *Ride, status string, chair *Chair, stops []RideStop) (*appGetNotificationResponseETA, error) {
+	if status != "ENROUTE" && status != "PICKUP" && status != "CARRYING" {
+		return nil, nil
+	}
+
+	location, err := getChairLocation(ctx, chair.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	speed, err := chairModelSpeedCache.Get(ctx, chair.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	// 記録されてから経過した分だけ進んでいるものとみなす
+	elapsed := time.Since(location.CreatedAt)
+	remaining := func(d time.Duration) int64 {
+		return max(d-elapsed, 0).Milliseconds()
+	}
+
+	// まだ回っていない経由地を順に回ってから目的地に向かう
+	remainingStops := []Coordinate{}
+	for _, s := range stops {
+		if !s.ArrivedAt.Valid {
+			remainingStops = append(remainingStops, Coordinate{Latitude: s.Latitude, Longitude: s.Longitude})
+		}
+	}
+	current := Coordinate{Latitude: location.Latitude, Longitude: location.Longitude}
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+
+	eta := &appGetNotificationResponseETA{
+		LocationRecordedAt: location.CreatedAt.UnixMilli(),
+	}
+	switch status {
+	case "ENROUTE":
+		pickupDistance := calculateDistance(current.Latitude, current.Longitude, pickup.Latitude, pickup.Longitude)
+		pickupIn := remaining(estimateTravelTime(pickupDistance, speed))
+		eta.PickupInMs = &pickupIn
+		eta.DestinationInMs = remaining(estimateTravelTime(pickupDistance+calculateRouteDistance(pickup, remainingStops, destination), speed))
+	case "PICKUP":
+		// 乗車待ちの間は出発していないので経過時間を差し引かない
+		eta.DestinationInMs = estimateTravelTime(calculateRouteDistance(current, remainingStops, destination), speed).Milliseconds()
+	case "CARRYING":
+		eta.DestinationInMs = remaining(estimateTravelTime(calculateRouteDistance(current, remainingStops, destination), speed))
+	}
+	return eta, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+// 料金の計算に必要なライドの条件
+type fareQuote struct {
+	Distance int
+	Pooled   bool
+	Tier     string
+}
+
+func quoteForRide(ride Ride) fareQuote {
+	q := fareQuote{Distance: rideDistance(ride), Pooled: ride.Pooled}
+	if ride.Tier != nil {
+		q.Tier = *ride.Tier
+	}
+	return q
+}
+
+// クーポン適用前の距離料金。ティアの割増の後に相乗りの割引をかける
+// 集計の作り直し (rebuildSalesAggregates) の SQL も同じ順で計算している
+func meteredFare(q fareQuote) int {
+	fare := farePerDistance * q.Distance
+	fare = fare * chairTierFarePercent(q.Tier) / 100
+	if q.Pooled {
+		fare = fare * (100 - pooledDiscountPercent) / 100
+	}
+	return fare
+}
+
+// クーポン適用前のライドの料金
+func rideFare(ride Ride) int {
+	return initialFare + meteredFare(quoteForRide(ride))
+}
+
+// クーポンの割引は距離料金にだけかかり、初乗り運賃は割り引かない
+func fareWithCoupon(q fareQuote, discount int) int {
+	return initialFare + max(meteredFare(q)-discount, 0)
+}
+
+type fareBreakdown struct {
+	InitialFare    int `json:"initial_fare"`
+	DistanceFare   int `json:"distance_fare"`
+	TierSurcharge  int `json:"tier_surcharge"`
+	PooledDiscount int `json:"pooled_discount"`
+	CouponDiscount int `json:"coupon_discount"`
+	Total          int `json:"total"`
+}
+
+// meteredFare と同じ順に計算した内訳
+func newFareBreakdown(q fareQuote, couponDiscount int) fareBreakdown {
+	distanceFare := farePerDistance * q.Distance
+	tiered := distanceFare * chairTierFarePercent(q.Tier) / 100
+	metered := meteredFare(q)
+	coupon := min(couponDiscount, metered)
+	return fareBreakdown{
+		InitialFare:    initialFare,
+		DistanceFare:   distanceFare,
+		TierSurcharge:  tiered - distanceFare,
+		PooledDiscount: tiered - metered,
+		CouponDiscount: coupon,
+		Total:          initialFare + metered - coupon,
+	}
+}
+
+func fareForDistance(distance int) int {
+	return initialFare + meteredFare(fareQuote{Distance: distance})
+}
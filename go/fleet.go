@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// 椅子の最新位置を返す。キャッシュに無ければ DB から引いてキャッシュする
+// 一度も位置を送っていない椅子は sql.ErrNoRows を返す
+func getChairLocation(ctx context.Context, chairID string) (*ChairLocation, error) {
+	if location, ok := chairLocationsCache.Load(chairID); ok {
+		return location.(*ChairLocation), nil
+	}
+	location := &ChairLocation{}
+	if err := database().GetContext(ctx, location, `SELECT * FROM chair_locations WHERE chair_id = ? ORDER BY created_at DESC LIMIT 1`, chairID); err != nil {
+		return nil, err
+	}
+	chairLocationsCache.Store(chairID, location)
+	return location, nil
+}
+
+// 椅子の位置更新をオーナーごとに配信する
+type chairLocationBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan *ChairLocation]struct{}
+}
+
+var fleetBroker = &chairLocationBroker{
+	subscribers: map[string]map[chan *ChairLocation]struct{}{},
+}
+
+func (b *chairLocationBroker) subscribe(ownerID string) (<-chan *ChairLocation, func()) {
+	ch := make(chan *ChairLocation, 64)
+
+	b.mu.Lock()
+	if b.subscribers[ownerID] == nil {
+		b.subscribers[ownerID] = map[chan *ChairLocation]struct{}{}
+	}
+	b.subscribers[ownerID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[ownerID], ch)
+		if len(b.subscribers[ownerID]) == 0 {
+			delete(b.subscribers, ownerID)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// 受信側が詰まっている場合は待たずに捨てる
+func (b *chairLocationBroker) publish(ownerID string, location *ChairLocation) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[ownerID] {
+		select {
+		case ch <- location:
+		default:
+		}
+	}
+}
@@ -12,6 +12,7 @@ require (
 	github.com/kaz/pprotein v1.2.4
 	github.com/motoki317/sc v1.8.1
 	github.com/oklog/ulid/v2 v2.1.0
+	golang.org/x/crypto v0.23.0
 )
 
 require (
@@ -42,7 +43,6 @@ require (
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/xanzy/ssh-agent v0.3.3 // indirect
 	golang.org/x/arch v0.8.0 // indirect
-	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/mod v0.12.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
@@ -5,45 +5,165 @@ import (
 	"database/sql"
 	"errors"
 	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
 )
 
 // このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
 func internalGetMatching(ctx context.Context) {
 	// MEMO: 一旦最も待たせているリクエストに適当な空いている椅子マッチさせる実装とする。おそらくもっといい方法があるはず…
-	ride := &Ride{}
-	if err := ridesDatabase().GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+	rides, err := ridesToMatch(ctx)
+	if err != nil {
+		slog.Error("Failed to fetch ride", "err", err)
+		return
+	}
+	// 希望に合う椅子がいないライドで、ほかの待っているライドを止めない
+	for i := range rides {
+		if matchRide(ctx, &rides[i]) {
 			return
 		}
-		slog.Error("Failed to fetch ride", err)
-		return
+	}
+}
+
+// 椅子を割り当てられたら true を返す
+func matchRide(ctx context.Context, ride *Ride) bool {
+	// 乗客がティアやモデルを希望していれば、それに合う椅子だけを候補にする
+	allowedModels, err := allowedModelsForRide(ctx, ride, time.Now())
+	if err != nil {
+		slog.Error("Failed to fetch ride preference", "err", err)
+		return false
+	}
+	chairQuery := "SELECT id FROM chairs WHERE is_active = TRUE AND pending_deactivation = FALSE"
+	chairArgs := []any{}
+	if allowedModels != nil {
+		if len(allowedModels) == 0 {
+			return false
+		}
+		models := make([]string, 0, len(allowedModels))
+		for m := range allowedModels {
+			models = append(models, m)
+		}
+		chairQuery, chairArgs, err = sqlx.In(chairQuery+" AND model IN (?)", models)
+		if err != nil {
+			slog.Error("Failed to build chair query", "err", err)
+			return false
+		}
+	}
+
+	// 相乗りのライドは、まず同じ方向に向かう相乗りのライドを運んでいる椅子を探す
+	if ride.Pooled {
+		chairID, route, err := findPooledChair(ctx, ride, allowedModels)
+		if err != nil {
+			slog.Error("Failed to find pooled chair", "err", err)
+			return false
+		}
+		if chairID != "" {
+			return assignRideToChair(ctx, ride, chairID, route)
+		}
 	}
 
 	matched := &Chair{}
 	empty := false
 	for i := 0; i < 10; i++ {
-		if err := ridesDatabase().GetContext(ctx, matched, "SELECT * FROM chairs INNER JOIN (SELECT id FROM chairs WHERE is_active = TRUE ORDER BY RAND() LIMIT 1) AS tmp ON chairs.id = tmp.id LIMIT 1"); err != nil {
+		if err := ridesDatabase().GetContext(ctx, matched, "SELECT * FROM chairs INNER JOIN ("+chairQuery+" ORDER BY RAND() LIMIT 1) AS tmp ON chairs.id = tmp.id LIMIT 1", chairArgs...); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				return
+				return false
 			}
-			slog.Error("Failed to fetch chair", err)
+			slog.Error("Failed to fetch chair", "err", err)
 		}
 
 		if err := ridesDatabase().GetContext(ctx, &empty, "SELECT COUNT(*) = 0 FROM (SELECT COUNT(chair_sent_at) = 6 AS completed FROM ride_statuses WHERE ride_id IN (SELECT id FROM rides WHERE chair_id = ?) GROUP BY ride_id) is_completed WHERE completed = FALSE", matched.ID); err != nil {
-			slog.Error("Failed to fetch chair", err)
-			return
+			slog.Error("Failed to fetch chair", "err", err)
+			return false
+		}
+		if !empty {
+			continue
+		}
+		// 営業エリアを登録している椅子にはその中で完結するライドだけを割り当てる
+		canServe, err := canChairServeRide(ctx, matched.ID, ride)
+		if err != nil {
+			slog.Error("Failed to check chair service areas", "err", err)
+			return false
 		}
-		if empty {
+		if canServe {
 			break
 		}
+		empty = false
 	}
 	if !empty {
-		return
+		return false
 	}
 
-	if _, err := ridesDatabase().ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
-		slog.Error("Failed to update ride", err)
-		return
+	return assignRideToChair(ctx, ride, matched.ID, nil)
+}
+
+// 選んでから割り当てるまでの間に停止された椅子には割り当てない
+// 相乗りで割り当てるときは route も同じトランザクションで記録し、記録できなければ割り当てを取り消す
+func assignRideToChair(ctx context.Context, ride *Ride, chairID string, route []poolWaypoint) bool {
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		slog.Error("Failed to begin transaction", "err", err)
+		return false
+	}
+	defer ridesTx.Rollback()
+
+	result, err := ridesTx.ExecContext(
+		ctx,
+		`UPDATE rides SET chair_id = ?
+			WHERE id = ? AND chair_id IS NULL
+			AND EXISTS (SELECT 1 FROM chairs WHERE id = ? AND is_active = TRUE AND pending_deactivation = FALSE)`,
+		chairID, ride.ID, chairID,
+	)
+	if err != nil {
+		slog.Error("Failed to update ride", "err", err)
+		return false
+	}
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		return false
+	}
+	if route != nil {
+		if err := saveChairPoolRoute(ctx, ridesTx, chairID, route); err != nil {
+			slog.Error("Failed to save pool route", "err", err)
+			return false
+		}
+	}
+	if err := ridesTx.Commit(); err != nil {
+		slog.Error("Failed to commit transaction", "err", err)
+		return false
 	}
 
+	if err := adjustRideTierToChair(ctx, ride, chairID); err != nil {
+		slog.Error("Failed to adjust ride tier", "err", err)
+	}
+	return true
+}
+
+// 待っているライドを古い順に返す
+// 椅子からの評価が低い利用者のライドは、ほかに待っているライドの後に回す
+// ただし lowRiderMaxDeferral より長く待たせたライドは後回しにしない
+func ridesToMatch(ctx context.Context) ([]Ride, error) {
+	rides := []Ride{}
+	if err := ridesDatabase().SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 10`); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ordered := make([]Ride, 0, len(rides))
+	deferred := []Ride{}
+	for _, ride := range rides {
+		if now.Sub(ride.CreatedAt) >= lowRiderMaxDeferral {
+			ordered = append(ordered, ride)
+			continue
+		}
+		score, err := riderScoreCache.Get(ctx, ride.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if score.isLow() {
+			deferred = append(deferred, ride)
+			continue
+		}
+		ordered = append(ordered, ride)
+	}
+	return append(ordered, deferred...), nil
 }
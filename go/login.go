@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// この期間に続けて失敗したら、期間が過ぎるまでログインを受け付けない
+var loginMaxFailures = func() int {
+	n := 5
+	if vStr, exists := os.LookupEnv("ISUCON_LOGIN_MAX_FAILURES"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val > 0 {
+			n = val
+		}
+	}
+	return n
+}()
+
+var loginFailureWindow = func() time.Duration {
+	seconds := 15 * 60
+	if vStr, exists := os.LookupEnv("ISUCON_LOGIN_FAILURE_WINDOW_SECONDS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val > 0 {
+			seconds = val
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}()
+
+// 有効期限内のコードは 1 アカウントあたりこの数まで発行する
+// 上限を超えた要求にも同じ応答を返し、コードは送らない
+var loginMaxActiveCodes = func() int {
+	n := 5
+	if vStr, exists := os.LookupEnv("ISUCON_LOGIN_MAX_ACTIVE_CODES"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val > 0 {
+			n = val
+		}
+	}
+	return n
+}()
+
+const (
+	loginCodeTTL      = 10 * time.Minute
+	minPasswordLength = 8
+	// bcrypt はこれより長い入力を扱えない
+	maxPasswordLength = 72
+)
+
+var (
+	errInvalidCredentials   = errors.New("invalid credentials")
+	errTooManyLoginFailures = errors.New("too many failed login attempts")
+)
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be between %d and %d bytes", minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+type loginSubject struct {
+	ID           string         `db:"id"`
+	PasswordHash sql.NullString `db:"password_hash"`
+}
+
+// 利用者はユーザー名、オーナーはオーナー名でログインする
+// 退会した利用者はログインできない
+func findLoginSubject(ctx context.Context, kind, identifier string) (*loginSubject, error) {
+	subject := &loginSubject{}
+	var err error
+	switch kind {
+	case sessionKindApp:
+		err = database().GetContext(ctx, subject, "SELECT id, password_hash FROM users WHERE username = ? AND deleted_at IS NULL", identifier)
+	case sessionKindOwner:
+		err = database().GetContext(ctx, subject, "SELECT id, password_hash FROM owners WHERE name = ?", identifier)
+	default:
+		return nil, fmt.Errorf("unknown login kind: %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return subject, nil
+}
+
+func checkLoginFailures(ctx context.Context, kind, identifier string) error {
+	var failures int
+	if err := database().GetContext(
+		ctx,
+		&failures,
+		"SELECT COUNT(*) FROM login_failures WHERE kind = ? AND identifier = ? AND created_at > ?",
+		kind, loginFailureIdentifier(identifier), time.Now().Add(-loginFailureWindow),
+	); err != nil {
+		return err
+	}
+	if failures >= loginMaxFailures {
+		return errTooManyLoginFailures
+	}
+	return nil
+}
+
+func loginFailureIdentifier(identifier string) string {
+	if len(identifier) > 255 {
+		return identifier[:255]
+	}
+	return identifier
+}
+
+// 試行を先に失敗として記録してから数える
+// 同時に送られた試行も、それぞれ先に記録された分を数えるので上限を超えて確かめることはない
+func recordLoginAttempt(ctx context.Context, kind, identifier string) error {
+	if _, err := database().ExecContext(ctx, "INSERT INTO login_failures (kind, identifier) VALUES (?, ?)", kind, loginFailureIdentifier(identifier)); err != nil {
+		return err
+	}
+	var attempts int
+	if err := database().GetContext(
+		ctx,
+		&attempts,
+		"SELECT COUNT(*) FROM login_failures WHERE kind = ? AND identifier = ? AND created_at > ?",
+		kind, loginFailureIdentifier(identifier), time.Now().Add(-loginFailureWindow),
+	); err != nil {
+		return err
+	}
+	if attempts > loginMaxFailures {
+		return errTooManyLoginFailures
+	}
+	return nil
+}
+
+// 存在しない名前でもパスワードを確かめるのと同じだけ時間をかけるためのハッシュ
+// 起動を遅らせないように、最初に必要になったときに作る
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secureRandomStr(16)), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// パスワードか、メールで送ったワンタイムコードのどちらかで確かめる
+// 存在しない名前でも失敗として数え、どちらで間違えたかは返さない
+func verifyLogin(ctx context.Context, kind, identifier, password, code string) (*loginSubject, error) {
+	if err := recordLoginAttempt(ctx, kind, identifier); err != nil {
+		return nil, err
+	}
+
+	subject, err := findLoginSubject(ctx, kind, identifier)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	ok := false
+	switch {
+	case password != "":
+		if subject != nil && subject.PasswordHash.Valid {
+			ok = bcrypt.CompareHashAndPassword([]byte(subject.PasswordHash.String), []byte(password)) == nil
+		} else {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		}
+	case code != "" && subject != nil:
+		ok, err = useLoginCode(ctx, kind, subject.ID, code)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+
+	if _, err := database().ExecContext(ctx, "DELETE FROM login_failures WHERE kind = ? AND identifier = ?", kind, loginFailureIdentifier(identifier)); err != nil {
+		return nil, err
+	}
+	return subject, nil
+}
+
+// 有効期限内の未使用のコードなら使用済みにして true を返す
+func useLoginCode(ctx context.Context, kind, subjectID, code string) (bool, error) {
+	result, err := database().ExecContext(
+		ctx,
+		"UPDATE login_codes SET used_at = CURRENT_TIMESTAMP(6) WHERE kind = ? AND subject_id = ? AND code_hash = ? AND used_at IS NULL AND expires_at > ?",
+		kind, subjectID, hashSessionToken(code), time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func generateLoginCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// 名前が存在するかどうかは応答から分からないようにする
+func sendLoginCode(ctx context.Context, kind, identifier string) error {
+	if err := checkLoginFailures(ctx, kind, identifier); err != nil {
+		return err
+	}
+
+	subject, err := findLoginSubject(ctx, kind, identifier)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	code, err := generateLoginCode()
+	if err != nil {
+		return err
+	}
+	// 同時に送られた要求でも上限を超えないように、先に発行してから数える
+	codeID := ulid.Make().String()
+	if _, err := database().ExecContext(
+		ctx,
+		"INSERT INTO login_codes (id, kind, subject_id, code_hash, expires_at) VALUES (?, ?, ?, ?, ?)",
+		codeID, kind, subject.ID, hashSessionToken(code), time.Now().Add(loginCodeTTL),
+	); err != nil {
+		return err
+	}
+	var activeCodes int
+	if err := database().GetContext(
+		ctx,
+		&activeCodes,
+		"SELECT COUNT(*) FROM login_codes WHERE kind = ? AND subject_id = ? AND created_at > ?",
+		kind, subject.ID, time.Now().Add(-loginCodeTTL),
+	); err != nil {
+		return err
+	}
+	if activeCodes > loginMaxActiveCodes {
+		_, err := database().ExecContext(ctx, "DELETE FROM login_codes WHERE id = ?", codeID)
+		return err
+	}
+
+	return sendMail(identifier, "ログインコード", fmt.Sprintf("ログインコード: %s\n%d分間有効です。", code, int(loginCodeTTL.Minutes())))
+}
+
+func writeLoginError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidCredentials):
+		writeError(w, http.StatusUnauthorized, err)
+	case errors.Is(err, errTooManyLoginFailures):
+		writeError(w, http.StatusTooManyRequests, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+type appPostLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type appPostLoginResponse struct {
+	ID string `json:"id"`
+}
+
+func appPostLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostLoginRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Username == "" || (req.Password == "") == (req.Code == "") {
+		writeError(w, http.StatusBadRequest, errors.New("username and either password or code are required"))
+		return
+	}
+
+	subject, err := verifyLogin(ctx, sessionKindApp, req.Username, req.Password, req.Code)
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	token, err := createSession(ctx, database(), r, sessionKindApp, subject.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setSessionCookie(w, sessionKindApp, token)
+
+	writeJSON(w, http.StatusOK, &appPostLoginResponse{ID: subject.ID})
+}
+
+type appPostLoginCodeRequest struct {
+	Username string `json:"username"`
+}
+
+func appPostLoginCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostLoginCodeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username is required"))
+		return
+	}
+
+	if err := sendLoginCode(ctx, sessionKindApp, req.Username); err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPostLoginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type ownerPostLoginResponse struct {
+	ID string `json:"id"`
+}
+
+func ownerPostLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &ownerPostLoginRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" || (req.Password == "") == (req.Code == "") {
+		writeError(w, http.StatusBadRequest, errors.New("name and either password or code are required"))
+		return
+	}
+
+	subject, err := verifyLogin(ctx, sessionKindOwner, req.Name, req.Password, req.Code)
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	token, err := createSession(ctx, database(), r, sessionKindOwner, subject.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setSessionCookie(w, sessionKindOwner, token)
+
+	writeJSON(w, http.StatusOK, &ownerPostLoginResponse{ID: subject.ID})
+}
+
+type ownerPostLoginCodeRequest struct {
+	Name string `json:"name"`
+}
+
+func ownerPostLoginCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &ownerPostLoginCodeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+
+	if err := sendLoginCode(ctx, sessionKindOwner, req.Name); err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// すでにパスワードがあれば今のパスワードも求める
+type putPasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+// 変更に成功したら、今のセッション以外はすべて失効させる
+func updatePassword(ctx context.Context, table string, session *Session, current sql.NullString, req *putPasswordRequest) error {
+	if current.Valid && bcrypt.CompareHashAndPassword([]byte(current.String), []byte(req.CurrentPassword)) != nil {
+		return errInvalidCredentials
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	if _, err := database().ExecContext(ctx, "UPDATE "+table+" SET password_hash = ? WHERE id = ?", hash, session.SubjectID); err != nil {
+		return err
+	}
+	return revokeOtherSessions(ctx, session)
+}
+
+func appPutPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	req := &putPasswordRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := updatePassword(ctx, "users", ctx.Value("session").(*Session), user.PasswordHash, req); err != nil {
+		writeLoginError(w, err)
+		return
+	}
+	userByIDCache.Forget(user.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ownerPutPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &putPasswordRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := updatePassword(ctx, "owners", ctx.Value("session").(*Session), owner.PasswordHash, req); err != nil {
+		writeLoginError(w, err)
+		return
+	}
+	ownerByIDCache.Forget(owner.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
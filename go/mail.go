@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// メールは送らずにこのファイルへ追記する
+var mailSinkPath = func() string {
+	if v, exists := os.LookupEnv("ISUCON_MAIL_SINK_PATH"); exists && v != "" {
+		return v
+	}
+	return "/tmp/isuride-mail.log"
+}()
+
+var mailSinkMu sync.Mutex
+
+func sendMail(to, subject, body string) error {
+	mailSinkMu.Lock()
+	defer mailSinkMu.Unlock()
+
+	f, err := os.OpenFile(mailSinkPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "To: %s\nSubject: %s\nDate: %s\n\n%s\n\n", to, subject, time.Now().UTC().Format(time.RFC1123Z), body)
+	return err
+}
@@ -26,13 +26,6 @@ var userByIDCache, _ = sc.New(func(ctx context.Context, id string) (*User, error
 	return &user, err
 }, 90*time.Second, 90*time.Second)
 
-var userByTokenCache, _ = sc.New(func(ctx context.Context, token string) (*User, error) {
-	var user User
-	query := "SELECT * FROM users WHERE access_token = ?"
-	err := database().GetContext(ctx, &user, query, token)
-	return &user, err
-}, 90*time.Second, 90*time.Second)
-
 var userByInviteCache, _ = sc.New(func(ctx context.Context, invite string) (*User, error) {
 	var user User
 	query := "SELECT * FROM users WHERE invitation_code = ?"
@@ -47,20 +40,6 @@ var ownerByIDCache, _ = sc.New(func(ctx context.Context, id string) (*Owner, err
 	return &owner, err
 }, 90*time.Second, 90*time.Second)
 
-var ownerByTokenCache, _ = sc.New(func(ctx context.Context, token string) (*Owner, error) {
-	var owner Owner
-	query := "SELECT * FROM owners WHERE access_token = ?"
-	err := database().GetContext(ctx, &owner, query, token)
-	return &owner, err
-}, 90*time.Second, 90*time.Second)
-
-var ownerByRegisterCache, _ = sc.New(func(ctx context.Context, register string) (*Owner, error) {
-	var owner Owner
-	query := "SELECT * FROM owners WHERE chair_register_token = ?"
-	err := database().GetContext(ctx, &owner, query, register)
-	return &owner, err
-}, 90*time.Second, 90*time.Second)
-
 var settingCache, _ = sc.New(func(ctx context.Context, name string) (string, error) {
 	var setting string
 	query := "SELECT value FROM settings WHERE name = ?"
@@ -97,6 +76,48 @@ func init() {
 var chairLocationsCache = sync.Map{}
 
 func main() {
+	// 集計の作り直し: ./isuride rebuild-sales
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-sales" {
+		initDatabase()
+		if err := rebuildSalesAggregates(context.Background()); err != nil {
+			slog.Error("failed to rebuild sales aggregates", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("sales aggregates rebuilt")
+		return
+	}
+
+	// 椅子の成績の検査: ./isuride check-chair-stats [--fix]
+	if len(os.Args) > 1 && os.Args[1] == "check-chair-stats" {
+		initDatabase()
+		ctx := context.Background()
+		drifts, err := checkChairStats(ctx)
+		if err != nil {
+			slog.Error("failed to check chair stats", "err", err)
+			os.Exit(1)
+		}
+		for _, d := range drifts {
+			slog.Warn("chair stats drift",
+				"chair_id", d.ChairID,
+				"ride_count", d.RideCount, "expected_ride_count", d.ExpectedRideCount,
+				"evaluation_sum", d.EvaluationSum, "expected_evaluation_sum", d.ExpectedEvaluationSum,
+			)
+		}
+		if len(drifts) == 0 {
+			slog.Info("chair stats are consistent")
+			return
+		}
+		if len(os.Args) > 2 && os.Args[2] == "--fix" {
+			if err := rebuildChairStats(ctx); err != nil {
+				slog.Error("failed to rebuild chair stats", "err", err)
+				os.Exit(1)
+			}
+			slog.Info("chair stats rebuilt", "drifted_chairs", len(drifts))
+			return
+		}
+		os.Exit(1)
+	}
+
 	mux := setup()
 
 	go func() {
@@ -114,6 +135,9 @@ func main() {
 		}
 	}()
 
+	go startRideTraceCompaction()
+	go startChairScheduler()
+
 	slog.Info("Listening on :8080")
 	http.ListenAndServe(":8080", mux)
 }
@@ -131,11 +155,11 @@ func setup() http.Handler {
 		}
 
 		if err != nil {
-			slog.Error("DB not ready", err)
+			slog.Error("DB not ready", "err", err)
 		}
 
 		if err2 != nil {
-			slog.Error("Rides DB not ready", err2)
+			slog.Error("Rides DB not ready", "err", err2)
 		}
 		time.Sleep(time.Second * 2)
 	}
@@ -149,13 +173,25 @@ func setup() http.Handler {
 	// app handlers
 	{
 		mux.HandleFunc("POST /api/app/users", appPostUsers)
+		mux.HandleFunc("POST /api/app/login", appPostLogin)
+		mux.HandleFunc("POST /api/app/login/code", appPostLoginCode)
 
 		authedMux := mux.With(appAuthMiddleware)
+		authedMux.HandleFunc("GET /api/app/me", appGetMe)
+		authedMux.HandleFunc("PATCH /api/app/me", appPatchMe)
+		authedMux.HandleFunc("DELETE /api/app/me", appDeleteMe)
+		authedMux.HandleFunc("PUT /api/app/me/password", appPutPassword)
+		authedMux.HandleFunc("GET /api/app/sessions", getSessions)
+		authedMux.HandleFunc("DELETE /api/app/sessions/{session_id}", deleteSession)
+		authedMux.HandleFunc("POST /api/app/logout", postLogout)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}", appGetRide)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/trace", appGetRideTrace)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/receipt", appGetRideReceipt)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
@@ -163,10 +199,35 @@ func setup() http.Handler {
 	// owner handlers
 	{
 		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
+		mux.HandleFunc("POST /api/owner/login", ownerPostLogin)
+		mux.HandleFunc("POST /api/owner/login/code", ownerPostLoginCode)
 
 		authedMux := mux.With(ownerAuthMiddleware)
+		authedMux.HandleFunc("GET /api/owner/sessions", getSessions)
+		authedMux.HandleFunc("DELETE /api/owner/sessions/{session_id}", deleteSession)
+		authedMux.HandleFunc("POST /api/owner/logout", postLogout)
+		authedMux.HandleFunc("PUT /api/owner/me/password", ownerPutPassword)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/timeseries", ownerGetSalesTimeseries)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		authedMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}", ownerDeleteChair)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/deactivate", ownerPostChairDeactivate)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/access-token", ownerPostChairAccessToken)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/transfer", ownerPostChairTransfer)
+		authedMux.HandleFunc("GET /api/owner/chair-register-tokens", ownerGetChairRegisterTokens)
+		authedMux.HandleFunc("GET /api/owner/fleet", ownerGetFleet)
+		authedMux.HandleFunc("GET /api/owner/fleet/stream", ownerGetFleetStream)
+		authedMux.HandleFunc("GET /api/owner/rides/{ride_id}/trace", ownerGetRideTrace)
+		authedMux.HandleFunc("GET /api/owner/suspicious-events", ownerGetSuspiciousEvents)
+		authedMux.HandleFunc("GET /api/owner/reviews", ownerGetReviews)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/service-areas", ownerGetChairServiceAreas)
+		authedMux.HandleFunc("PUT /api/owner/chairs/{chair_id}/service-areas", ownerPutChairServiceAreas)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/schedule", ownerGetChairSchedule)
+		authedMux.HandleFunc("PUT /api/owner/chairs/{chair_id}/schedule", ownerPutChairSchedule)
+		authedMux.HandleFunc("GET /api/owner/chairs/availability", ownerGetChairAvailability)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens", ownerPostChairRegisterTokens)
+		authedMux.HandleFunc("DELETE /api/owner/chair-register-tokens/{token_id}", ownerDeleteChairRegisterToken)
 	}
 
 	// chair handlers
@@ -174,10 +235,25 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/chair/chairs", chairPostChairs)
 
 		authedMux := mux.With(chairAuthMiddleware)
+		authedMux.HandleFunc("POST /api/chair/logout", postLogout)
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
+		authedMux.HandleFunc("POST /api/chair/coordinates", chairPostCoordinates)
 		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/stops/{stop_index}/arrival", chairPostRideStopArrival)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/rating", chairPostRideRating)
+	}
+
+	// operator handlers
+	{
+		authedMux := mux.With(operatorAuthMiddleware)
+		authedMux.HandleFunc("GET /api/operator/suspicious-events", operatorGetSuspiciousEvents)
+		authedMux.HandleFunc("GET /api/operator/service-areas", operatorGetServiceAreas)
+		authedMux.HandleFunc("POST /api/operator/service-areas", operatorPostServiceArea)
+		authedMux.HandleFunc("DELETE /api/operator/service-areas/{area_id}", operatorDeleteServiceArea)
+		authedMux.HandleFunc("GET /api/operator/reviews", operatorGetReviews)
+		authedMux.HandleFunc("PATCH /api/operator/reviews/{ride_id}", operatorPatchReview)
 	}
 
 	// internal handlers
@@ -221,17 +297,35 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := rebuildSalesAggregates(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := rebuildChairStats(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := migrateLegacySessions(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	settingCache.Purge()
 	paymentTokenCache.Purge()
 
 	userByIDCache.Purge()
-	userByTokenCache.Purge()
 	userByInviteCache.Purge()
-	chairAccessTokenCache.Purge()
+	chairByIDCache.Purge()
 
 	ownerByIDCache.Purge()
-	ownerByTokenCache.Purge()
-	ownerByRegisterCache.Purge()
+
+	chairModelSpeedCache.Purge()
+	serviceAreasCache.Purge()
+	chairModelTiersCache.Purge()
+	chairServiceAreasCache.Purge()
+	riderScoreCache.Purge()
 
 	// pproteinにcollect requestを飛ばす
 	if os.Getenv("PROD") != "true" {
@@ -276,7 +370,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "err", err)
 }
 
 func secureRandomStr(b int) string {
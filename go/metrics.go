@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type RideMetrics struct {
+	RideID           string `db:"ride_id"`
+	PickupDistance   int    `db:"pickup_distance"`
+	CarryingDistance int    `db:"carrying_distance"`
+	WaitTimeMs       int64  `db:"wait_time_ms"`
+	PickupTimeMs     int64  `db:"pickup_time_ms"`
+	TripTimeMs       int64  `db:"trip_time_ms"`
+}
+
+// 椅子の移動距離をライドの状態に応じて迎車中・乗車中の距離に加算する
+func addRideDistance(ctx context.Context, ridesTx *sqlx.Tx, rideID, status string, distance int) error {
+	pickupDistance, carryingDistance := 0, 0
+	switch status {
+	case "ENROUTE":
+		pickupDistance = distance
+	case "CARRYING":
+		carryingDistance = distance
+	default:
+		return nil
+	}
+	_, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO ride_metrics (ride_id, pickup_distance, carrying_distance) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+				pickup_distance = pickup_distance + VALUES(pickup_distance),
+				carrying_distance = carrying_distance + VALUES(carrying_distance)`,
+		rideID, pickupDistance, carryingDistance,
+	)
+	return err
+}
+
+// ride_statuses の記録日時から各区間の所要時間を求めて保存する
+// ライドが COMPLETED になったときに呼ぶ
+func finalizeRideMetrics(ctx context.Context, ridesTx *sqlx.Tx, rideID string) (*RideMetrics, error) {
+	statuses := []RideStatus{}
+	if err := ridesTx.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at`, rideID); err != nil {
+		return nil, err
+	}
+	statusAt := map[string]time.Time{}
+	for _, s := range statuses {
+		statusAt[s.Status] = s.CreatedAt
+	}
+	between := func(from, to string) int64 {
+		fromAt, ok1 := statusAt[from]
+		toAt, ok2 := statusAt[to]
+		if !ok1 || !ok2 {
+			return 0
+		}
+		return toAt.Sub(fromAt).Milliseconds()
+	}
+
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO ride_metrics (ride_id, wait_time_ms, pickup_time_ms, trip_time_ms) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+				wait_time_ms = VALUES(wait_time_ms),
+				pickup_time_ms = VALUES(pickup_time_ms),
+				trip_time_ms = VALUES(trip_time_ms)`,
+		rideID, between("MATCHING", "ENROUTE"), between("ENROUTE", "PICKUP"), between("CARRYING", "ARRIVED"),
+	); err != nil {
+		return nil, err
+	}
+
+	return getRideMetrics(ctx, ridesTx, rideID)
+}
+
+// 記録がまだ無いライドは全て0で返す
+func getRideMetrics(ctx context.Context, tx executableGet, rideID string) (*RideMetrics, error) {
+	metrics := &RideMetrics{}
+	if err := tx.GetContext(ctx, metrics, `SELECT * FROM ride_metrics WHERE ride_id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &RideMetrics{RideID: rideID}, nil
+		}
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// 初期データの ride_statuses から完了済みライドの所要時間を作り直す
+// 移動距離は座標の履歴が残っていないので触らない
+func rebuildRideMetrics(ctx context.Context, ridesTx *sqlx.Tx) error {
+	_, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO ride_metrics (ride_id, wait_time_ms, pickup_time_ms, trip_time_ms)
+			SELECT ride_id,
+			       IFNULL(TIMESTAMPDIFF(MICROSECOND, MAX(CASE WHEN status = 'MATCHING' THEN created_at END), MAX(CASE WHEN status = 'ENROUTE' THEN created_at END)) DIV 1000, 0),
+			       IFNULL(TIMESTAMPDIFF(MICROSECOND, MAX(CASE WHEN status = 'ENROUTE' THEN created_at END), MAX(CASE WHEN status = 'PICKUP' THEN created_at END)) DIV 1000, 0),
+			       IFNULL(TIMESTAMPDIFF(MICROSECOND, MAX(CASE WHEN status = 'CARRYING' THEN created_at END), MAX(CASE WHEN status = 'ARRIVED' THEN created_at END)) DIV 1000, 0)
+			FROM ride_statuses
+			GROUP BY ride_id
+			HAVING SUM(status = 'COMPLETED') > 0
+			ON DUPLICATE KEY UPDATE
+				wait_time_ms = VALUES(wait_time_ms),
+				pickup_time_ms = VALUES(pickup_time_ms),
+				trip_time_ms = VALUES(trip_time_ms)`,
+	)
+	return err
+}
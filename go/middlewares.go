@@ -5,40 +5,45 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/motoki317/sc"
 )
 
+// セッションの認証に失敗したときのレスポンス
+func writeSessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidSession) {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	var cookieErr *sessionCookieRequiredError
+	if errors.As(err, &cookieErr) {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
 func appAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		c, err := r.Cookie("app_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("app_session cookie is required"))
+		session, err := authenticateSession(ctx, r, sessionKindApp)
+		if err != nil {
+			writeSessionError(w, err)
 			return
 		}
-		accessToken := c.Value
-		// user := &User{}
-		// err = database().GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
-		// if err != nil {
-		// 	if errors.Is(err, sql.ErrNoRows) {
-		// 		writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-		// 		return
-		// 	}
-		// 	writeError(w, http.StatusInternalServerError, err)
-		// 	return
-		// }
 
-		user, err := userByTokenCache.Get(ctx, accessToken)
+		user, err := userByIDCache.Get(ctx, session.SubjectID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, http.StatusUnauthorized, errInvalidSession)
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		ctx = context.WithValue(ctx, "session", session)
 		ctx = context.WithValue(ctx, "user", user)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -47,32 +52,23 @@ func appAuthMiddleware(next http.Handler) http.Handler {
 func ownerAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		c, err := r.Cookie("owner_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("owner_session cookie is required"))
+		session, err := authenticateSession(ctx, r, sessionKindOwner)
+		if err != nil {
+			writeSessionError(w, err)
 			return
 		}
-		accessToken := c.Value
-		// owner := &Owner{}
-		// if err := database().GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
-		// 	if errors.Is(err, sql.ErrNoRows) {
-		// 		writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-		// 		return
-		// 	}
-		// 	writeError(w, http.StatusInternalServerError, err)
-		// 	return
-		// }
 
-		owner, err := ownerByTokenCache.Get(ctx, accessToken)
+		owner, err := ownerByIDCache.Get(ctx, session.SubjectID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, http.StatusUnauthorized, errInvalidSession)
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
+		ctx = context.WithValue(ctx, "session", session)
 		ctx = context.WithValue(ctx, "owner", owner)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -81,30 +77,32 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 func chairAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		c, err := r.Cookie("chair_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("chair_session cookie is required"))
+		session, err := authenticateSession(ctx, r, sessionKindChair)
+		if err != nil {
+			writeSessionError(w, err)
 			return
 		}
-		accessToken := c.Value
-		chairOnlyNoChange, err := chairAccessTokenCache.Get(ctx, accessToken)
+
+		chairOnlyNoChange, err := chairByIDCache.Get(ctx, session.SubjectID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, http.StatusUnauthorized, errInvalidSession)
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
+		ctx = context.WithValue(ctx, "session", session)
 		ctx = context.WithValue(ctx, "chairOnlyNoChange", chairOnlyNoChange)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-var chairAccessTokenCache, _ = sc.New(func(ctx context.Context, key string) (*ChairOnlyNoChange, error) {
+// 削除された椅子は引けないようにする
+var chairByIDCache, _ = sc.New(func(ctx context.Context, id string) (*ChairOnlyNoChange, error) {
 	chair := Chair{}
-	err := ridesDatabase().GetContext(ctx, &chair, "SELECT * FROM chairs WHERE access_token = ?", key)
+	err := ridesDatabase().GetContext(ctx, &chair, "SELECT * FROM chairs WHERE id = ? AND deleted_at IS NULL", id)
 	if err != nil {
 		return &ChairOnlyNoChange{}, err
 	}
@@ -120,3 +118,16 @@ var chairAccessTokenCache, _ = sc.New(func(ctx context.Context, key string) (*Ch
 
 	return chairOnlyNoChange, nil
 }, 1*time.Minute, 5*time.Minute)
+
+// 運営向けの API は ISUCON_OPERATOR_TOKEN を Bearer トークンとして要求する
+// 未設定の場合はすべて拒否する
+func operatorAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ISUCON_OPERATOR_TOKEN")
+		if token == "" || r.Header.Get("Authorization") != "Bearer "+token {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid operator token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -6,16 +6,19 @@ import (
 )
 
 type Chair struct {
-	ID                     string       `db:"id"`
-	OwnerID                string       `db:"owner_id"`
-	Name                   string       `db:"name"`
-	Model                  string       `db:"model"`
-	IsActive               bool         `db:"is_active"`
-	AccessToken            string       `db:"access_token"`
-	CreatedAt              time.Time    `db:"created_at"`
-	UpdatedAt              time.Time    `db:"updated_at"`
-	TotalDistance          int          `db:"total_distance"`
-	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	ID                     string         `db:"id"`
+	OwnerID                string         `db:"owner_id"`
+	Name                   string         `db:"name"`
+	Model                  string         `db:"model"`
+	IsActive               bool           `db:"is_active"`
+	AccessToken            string         `db:"access_token"`
+	CreatedAt              time.Time      `db:"created_at"`
+	UpdatedAt              time.Time      `db:"updated_at"`
+	TotalDistance          int            `db:"total_distance"`
+	TotalDistanceUpdatedAt sql.NullTime   `db:"total_distance_updated_at"`
+	DeletedAt              sql.NullTime   `db:"deleted_at"`
+	RegisterTokenID        sql.NullString `db:"register_token_id"`
+	PendingDeactivation    bool           `db:"pending_deactivation"`
 }
 
 type ChairOnlyNoChange struct {
@@ -42,15 +45,17 @@ type ChairLocation struct {
 }
 
 type User struct {
-	ID             string    `db:"id"`
-	Username       string    `db:"username"`
-	Firstname      string    `db:"firstname"`
-	Lastname       string    `db:"lastname"`
-	DateOfBirth    string    `db:"date_of_birth"`
-	AccessToken    string    `db:"access_token"`
-	InvitationCode string    `db:"invitation_code"`
-	CreatedAt      time.Time `db:"created_at"`
-	UpdatedAt      time.Time `db:"updated_at"`
+	ID             string         `db:"id"`
+	Username       string         `db:"username"`
+	Firstname      string         `db:"firstname"`
+	Lastname       string         `db:"lastname"`
+	DateOfBirth    string         `db:"date_of_birth"`
+	AccessToken    string         `db:"access_token"`
+	InvitationCode string         `db:"invitation_code"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
+	DeletedAt      sql.NullTime   `db:"deleted_at"`
+	PasswordHash   sql.NullString `db:"password_hash"`
 }
 
 type PaymentToken struct {
@@ -70,6 +75,10 @@ type Ride struct {
 	Evaluation           *int           `db:"evaluation"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	RouteDistance        *int           `db:"route_distance"`
+	Pooled               bool           `db:"pooled"`
+	Tier                 *string        `db:"tier"`
+	AllowTierFallback    bool           `db:"allow_tier_fallback"`
 }
 
 type RideStatus struct {
@@ -82,12 +91,24 @@ type RideStatus struct {
 }
 
 type Owner struct {
-	ID                 string    `db:"id"`
-	Name               string    `db:"name"`
-	AccessToken        string    `db:"access_token"`
-	ChairRegisterToken string    `db:"chair_register_token"`
-	CreatedAt          time.Time `db:"created_at"`
-	UpdatedAt          time.Time `db:"updated_at"`
+	ID                 string         `db:"id"`
+	Name               string         `db:"name"`
+	AccessToken        string         `db:"access_token"`
+	ChairRegisterToken string         `db:"chair_register_token"`
+	CreatedAt          time.Time      `db:"created_at"`
+	UpdatedAt          time.Time      `db:"updated_at"`
+	PasswordHash       sql.NullString `db:"password_hash"`
+}
+
+type ChairRegisterToken struct {
+	ID        string       `db:"id"`
+	OwnerID   string       `db:"owner_id"`
+	Token     string       `db:"token"`
+	MaxUses   *int         `db:"max_uses"`
+	UsedCount int          `db:"used_count"`
+	ExpiresAt sql.NullTime `db:"expires_at"`
+	RevokedAt sql.NullTime `db:"revoked_at"`
+	CreatedAt time.Time    `db:"created_at"`
 }
 
 type Coupon struct {
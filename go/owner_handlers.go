@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -37,24 +43,49 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ownerID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
 	chairRegisterToken := secureRandomStr(32)
 
-	_, err := database().ExecContext(
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	accessToken, err := createSession(ctx, tx, r, sessionKindOwner, ownerID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// access_token には最初のセッションのトークンのハッシュだけを残す
+	_, err = tx.ExecContext(
 		ctx,
 		"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)",
-		ownerID, req.Name, accessToken, chairRegisterToken,
+		ownerID, req.Name, hashSessionToken(accessToken), chairRegisterToken,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "owner_session",
-		Value: accessToken,
-	})
+	// 登録時のトークンは期限・回数制限なしで発行する
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO chair_register_tokens (id, owner_id, token) VALUES (?, ?, ?)",
+		ulid.Make().String(), ownerID, chairRegisterToken,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	setSessionCookie(w, sessionKindOwner, accessToken)
 
 	writeJSON(w, http.StatusCreated, &ownerPostOwnersResponse{
 		ID:                 ownerID,
@@ -79,47 +110,73 @@ type ownerGetSalesResponse struct {
 	Models     []modelSales `json:"models"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	since := time.Unix(0, 0)
-	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+// 売上の集計期間をクエリパラメータの since, until (UNIX ミリ秒) から読む
+func parseSalesRange(r *http.Request) (since, until time.Time, err error) {
+	since = time.Unix(0, 0)
+	until = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return time.Time{}, time.Time{}, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return time.Time{}, time.Time{}, err
 		}
 		until = time.UnixMilli(parsed)
 	}
+	return since, until, nil
+}
+
+func ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSalesRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	owner := r.Context().Value("owner").(*Owner)
 
-	tx, err := database().Beginx()
-	if err != nil {
+	chairs := []Chair{}
+	if err := ridesDatabase().SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
 
-	ridesTx, err := ridesDatabase().Beginx()
+	// until はミリ秒単位で含む
+	salesByChair, err := getOwnerChairSales(ctx, owner.ID, since, until.Add(time.Millisecond))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer ridesTx.Rollback()
 
-	chairs := []Chair{}
-	if err := ridesTx.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	// 譲渡した椅子も、所有していた間の売上があれば載せる
+	transferred := []string{}
+	owned := map[string]bool{}
+	for _, chair := range chairs {
+		owned[chair.ID] = true
+	}
+	for chairID := range salesByChair {
+		if !owned[chairID] {
+			transferred = append(transferred, chairID)
+		}
+	}
+	if len(transferred) > 0 {
+		query, args, err := sqlx.In("SELECT * FROM chairs WHERE id IN (?)", transferred)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		transferredChairs := []Chair{}
+		if err := ridesDatabase().SelectContext(ctx, &transferredChairs, query, args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		chairs = append(chairs, transferredChairs...)
 	}
 
 	res := ownerGetSalesResponse{
@@ -128,13 +185,7 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 
 	modelSalesByModel := map[string]int{}
 	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := ridesTx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		sales := sumSales(rides)
+		sales := salesByChair[chair.ID]
 		res.TotalSales += sales
 
 		res.Chairs = append(res.Chairs, chairSales{
@@ -158,16 +209,137 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
+type ownerGetSalesTimeseriesResponse struct {
+	Bucket string                   `json:"bucket"`
+	Series []ownerSalesBucketSeries `json:"series"`
+}
+
+type ownerSalesBucketSeries struct {
+	Start            int64   `json:"start"`
+	Sales            int     `json:"sales"`
+	RideCount        int     `json:"ride_count"`
+	EvaluationAvg    float64 `json:"evaluation_avg"`
+	PickupDistance   int     `json:"pickup_distance"`
+	CarryingDistance int     `json:"carrying_distance"`
+	AvgWaitTimeMs    int64   `json:"avg_wait_time_ms"`
+	AvgPickupTimeMs  int64   `json:"avg_pickup_time_ms"`
+	AvgTripTimeMs    int64   `json:"avg_trip_time_ms"`
+}
+
+func ownerGetSalesTimeseries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	query := r.URL.Query()
+
+	since, until, err := parseSalesRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	bucket := salesBucketDay
+	if query.Get("bucket") != "" {
+		bucket = query.Get("bucket")
+	}
+	if !isValidSalesBucket(bucket) {
+		writeError(w, http.StatusBadRequest, errors.New("bucket must be one of hour, day, week, month"))
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be json or csv"))
+		return
+	}
+
+	// 集計は時単位なので、期間に丸ごと含まれる時間帯だけを拾う
+	// since は次の時間帯の始まりに切り上げ、until (ミリ秒単位で含む) で終わらない時間帯は除く
+	firstHour := since.Truncate(time.Hour)
+	if firstHour.Before(since) {
+		firstHour = firstHour.Add(time.Hour)
+	}
+	lastHour := until.Add(time.Millisecond).Add(-time.Hour)
+	sqlQuery := `SELECT chair_sales_hourly.*
+		FROM chair_sales_hourly
+		JOIN chairs ON chairs.id = chair_sales_hourly.chair_id
+		WHERE chair_sales_hourly.owner_id = ? AND chair_sales_hourly.hour BETWEEN ? AND ?`
+	args := []interface{}{owner.ID, firstHour, lastHour}
+	if chairID := query.Get("chair_id"); chairID != "" {
+		sqlQuery += " AND chairs.id = ?"
+		args = append(args, chairID)
+	}
+	if model := query.Get("model"); model != "" {
+		sqlQuery += " AND chairs.model = ?"
+		args = append(args, model)
+	}
+	sqlQuery += " ORDER BY chair_sales_hourly.hour"
+
+	rows := []ChairSalesHourly{}
+	if err := ridesDatabase().SelectContext(ctx, &rows, sqlQuery, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	series := []ownerSalesBucketSeries{}
+	totals := []ChairSalesHourly{}
+	for _, row := range rows {
+		start := truncateToSalesBucket(row.Hour, bucket).UnixMilli()
+		if len(series) == 0 || series[len(series)-1].Start != start {
+			series = append(series, ownerSalesBucketSeries{Start: start})
+			totals = append(totals, ChairSalesHourly{})
+		}
+		i := len(series) - 1
+		series[i].Sales += row.Sales
+		series[i].RideCount += row.RideCount
+		series[i].PickupDistance += row.PickupDistance
+		series[i].CarryingDistance += row.CarryingDistance
+		totals[i].EvaluationSum += row.EvaluationSum
+		totals[i].WaitTimeMs += row.WaitTimeMs
+		totals[i].PickupTimeMs += row.PickupTimeMs
+		totals[i].TripTimeMs += row.TripTimeMs
+	}
+	for i := range series {
+		if count := series[i].RideCount; count > 0 {
+			series[i].EvaluationAvg = float64(totals[i].EvaluationSum) / float64(count)
+			series[i].AvgWaitTimeMs = totals[i].WaitTimeMs / int64(count)
+			series[i].AvgPickupTimeMs = totals[i].PickupTimeMs / int64(count)
+			series[i].AvgTripTimeMs = totals[i].TripTimeMs / int64(count)
+		}
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv;charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"start", "sales", "ride_count", "evaluation_avg", "pickup_distance", "carrying_distance", "avg_wait_time_ms", "avg_pickup_time_ms", "avg_trip_time_ms"})
+		for _, s := range series {
+			cw.Write([]string{
+				time.UnixMilli(s.Start).UTC().Format(time.RFC3339),
+				strconv.Itoa(s.Sales),
+				strconv.Itoa(s.RideCount),
+				strconv.FormatFloat(s.EvaluationAvg, 'f', 2, 64),
+				strconv.Itoa(s.PickupDistance),
+				strconv.Itoa(s.CarryingDistance),
+				strconv.FormatInt(s.AvgWaitTimeMs, 10),
+				strconv.FormatInt(s.AvgPickupTimeMs, 10),
+				strconv.FormatInt(s.AvgTripTimeMs, 10),
+			})
+		}
+		cw.Flush()
+		return
 	}
-	return sale
+
+	writeJSON(w, http.StatusOK, &ownerGetSalesTimeseriesResponse{
+		Bucket: bucket,
+		Series: series,
+	})
 }
 
 func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	return rideFare(ride)
 }
 
 type chairWithDetail struct {
@@ -181,6 +353,7 @@ type chairWithDetail struct {
 	UpdatedAt              time.Time    `db:"updated_at"`
 	TotalDistance          int          `db:"total_distance"`
 	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	PendingDeactivation    bool         `db:"pending_deactivation"`
 }
 
 type ownerGetChairResponse struct {
@@ -192,6 +365,7 @@ type ownerGetChairResponseChair struct {
 	Name                   string `json:"name"`
 	Model                  string `json:"model"`
 	Active                 bool   `json:"active"`
+	State                  string `json:"state"`
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
@@ -211,8 +385,9 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
        created_at,
        updated_at,
        IFNULL(total_distance, 0) AS total_distance,
-       total_distance_updated_at
-			FROM chairs WHERE owner_id = ?
+       total_distance_updated_at,
+       pending_deactivation
+			FROM chairs WHERE owner_id = ? AND deleted_at IS NULL
 `, owner.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -225,6 +400,7 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 			Name:          chair.Name,
 			Model:         chair.Model,
 			Active:        chair.IsActive,
+			State:         chairState(chair.IsActive, chair.PendingDeactivation),
 			RegisteredAt:  chair.CreatedAt.UnixMilli(),
 			TotalDistance: chair.TotalDistance,
 		}
@@ -236,3 +412,766 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+// オーナーが所有する(削除されていない)椅子を行ロック付きで取得する
+func getOwnedChairForUpdate(ctx context.Context, ridesTx *sqlx.Tx, ownerID, chairID string) (*Chair, error) {
+	chair := &Chair{}
+	if err := ridesTx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? AND deleted_at IS NULL FOR UPDATE", chairID, ownerID); err != nil {
+		return nil, err
+	}
+	return chair, nil
+}
+
+// 椅子に割り当てられたライドのうち未完了のものがあるか
+// 相乗りでは複数のライドを同時に運ぶので、最新のライドだけでなくすべてを見る
+func hasChairActiveRide(ctx context.Context, tx sqlx.QueryerContext, chairID string) (bool, error) {
+	rides, err := getChairActiveRides(ctx, tx, chairID)
+	if err != nil {
+		return false, err
+	}
+	return len(rides) > 0, nil
+}
+
+type ownerPatchChairRequest struct {
+	Name  *string `json:"name"`
+	Model *string `json:"model"`
+}
+
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == nil && req.Model == nil {
+		writeError(w, http.StatusBadRequest, errors.New("some of fields(name, model) are required"))
+		return
+	}
+	if req.Name != nil && (*req.Name == "" || utf8.RuneCountInString(*req.Name) > 30) {
+		writeError(w, http.StatusBadRequest, errors.New("name must be 1 to 30 characters"))
+		return
+	}
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	chair, err := getOwnedChairForUpdate(ctx, ridesTx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	name := chair.Name
+	if req.Name != nil {
+		name = *req.Name
+	}
+	model := chair.Model
+	if req.Model != nil {
+		chairModel := &ChairModel{}
+		if err := ridesTx.GetContext(ctx, chairModel, "SELECT * FROM chair_models WHERE name = ?", *req.Model); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusBadRequest, errors.New("unknown chair model"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		model = chairModel.Name
+	}
+
+	if _, err := ridesTx.ExecContext(ctx, "UPDATE chairs SET name = ?, model = ? WHERE id = ?", name, model, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chairByIDCache.Forget(chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ownerPostChairDeactivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	chair, err := getOwnedChairForUpdate(ctx, ridesTx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := setChairActive(ctx, ridesTx, chair.ID, false, chairActivityReasonOwner); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPostChairAccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// 椅子のアクセストークンを失効させて再発行する
+func ownerPostChairAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	chair, err := getOwnedChairForUpdate(ctx, ridesTx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	accessToken, err := createSession(ctx, tx, r, sessionKindChair, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := ridesTx.ExecContext(ctx, "UPDATE chairs SET access_token = ? WHERE id = ?", hashSessionToken(accessToken), chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 新しいトークンが使えるようになってから、古いトークンを失効させる
+	session, err := getSessionByTokenHash(ctx, hashSessionToken(accessToken))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := revokeOtherSessions(ctx, session); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chairByIDCache.Forget(chair.ID)
+
+	writeJSON(w, http.StatusOK, &ownerPostChairAccessTokenResponse{
+		AccessToken: accessToken,
+	})
+}
+
+// 椅子を論理削除する。ライド履歴や売上は残す
+func ownerDeleteChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	chair, err := getOwnedChairForUpdate(ctx, ridesTx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	active, err := hasChairActiveRide(ctx, ridesTx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if active {
+		writeError(w, http.StatusConflict, errors.New("chair has an active ride"))
+		return
+	}
+
+	if err := updateChairActive(ctx, ridesTx, chair.ID, false, chairActivityReasonDeleted); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		"UPDATE chairs SET access_token = ?, deleted_at = CURRENT_TIMESTAMP(6) WHERE id = ?",
+		hashSessionToken(secureRandomStr(32)), chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 削除が確定してからセッションを失効させて、以降のリクエストを受け付けないようにする
+	if err := revokeSubjectSessions(ctx, sessionKindChair, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chairByIDCache.Forget(chair.ID)
+	chairLocationsCache.Delete(chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPostChairTransferRequest struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+// 椅子を別のオーナーに譲渡する。受け取り側の椅子登録トークンで譲渡先を指定する
+func ownerPostChairTransfer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPostChairTransferRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.ChairRegisterToken == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(chair_register_token) are empty"))
+		return
+	}
+
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 譲渡では登録トークンの使用回数は消費しない
+	registerToken, err := getUsableChairRegisterTokenForUpdate(ctx, tx, req.ChairRegisterToken)
+	if err != nil {
+		if errors.Is(err, errUnusableChairRegisterToken) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if registerToken.OwnerID == owner.ID {
+		writeError(w, http.StatusBadRequest, errors.New("chair is already owned by this owner"))
+		return
+	}
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	chair, err := getOwnedChairForUpdate(ctx, ridesTx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	active, err := hasChairActiveRide(ctx, ridesTx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if active {
+		writeError(w, http.StatusConflict, errors.New("chair has an active ride"))
+		return
+	}
+
+	if _, err := ridesTx.ExecContext(ctx, "UPDATE chairs SET owner_id = ? WHERE id = ?", registerToken.OwnerID, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordChairOwnershipTransfer(ctx, ridesTx, chair, registerToken.OwnerID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chairByIDCache.Forget(chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errUnusableChairRegisterToken = errors.New("invalid chair_register_token")
+
+// 椅子登録トークンを行ロック付きで取得する
+// 失効・期限切れ・使用回数超過のトークンは errUnusableChairRegisterToken を返す
+func getUsableChairRegisterTokenForUpdate(ctx context.Context, tx *sqlx.Tx, token string) (*ChairRegisterToken, error) {
+	registerToken := &ChairRegisterToken{}
+	if err := tx.GetContext(ctx, registerToken, "SELECT * FROM chair_register_tokens WHERE token = ? FOR UPDATE", token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errUnusableChairRegisterToken
+		}
+		return nil, err
+	}
+	if registerToken.RevokedAt.Valid {
+		return nil, errUnusableChairRegisterToken
+	}
+	if registerToken.ExpiresAt.Valid && !time.Now().Before(registerToken.ExpiresAt.Time) {
+		return nil, errUnusableChairRegisterToken
+	}
+	if registerToken.MaxUses != nil && registerToken.UsedCount >= *registerToken.MaxUses {
+		return nil, errUnusableChairRegisterToken
+	}
+	return registerToken, nil
+}
+
+type ownerPostChairRegisterTokensRequest struct {
+	ExpiresAt *int64 `json:"expires_at"`
+	MaxUses   *int   `json:"max_uses"`
+}
+
+type ownerChairRegisterToken struct {
+	ID        string                         `json:"id"`
+	Token     string                         `json:"token"`
+	MaxUses   *int                           `json:"max_uses"`
+	UsedCount int                            `json:"used_count"`
+	ExpiresAt *int64                         `json:"expires_at"`
+	RevokedAt *int64                         `json:"revoked_at"`
+	CreatedAt int64                          `json:"created_at"`
+	Chairs    []ownerChairRegisterTokenChair `json:"chairs"`
+}
+
+type ownerChairRegisterTokenChair struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func newOwnerChairRegisterToken(t *ChairRegisterToken) ownerChairRegisterToken {
+	res := ownerChairRegisterToken{
+		ID:        t.ID,
+		Token:     t.Token,
+		MaxUses:   t.MaxUses,
+		UsedCount: t.UsedCount,
+		CreatedAt: t.CreatedAt.UnixMilli(),
+		Chairs:    []ownerChairRegisterTokenChair{},
+	}
+	if t.ExpiresAt.Valid {
+		expiresAt := t.ExpiresAt.Time.UnixMilli()
+		res.ExpiresAt = &expiresAt
+	}
+	if t.RevokedAt.Valid {
+		revokedAt := t.RevokedAt.Time.UnixMilli()
+		res.RevokedAt = &revokedAt
+	}
+	return res
+}
+
+func ownerPostChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostChairRegisterTokensRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	registerToken := &ChairRegisterToken{
+		ID:        ulid.Make().String(),
+		OwnerID:   owner.ID,
+		Token:     secureRandomStr(32),
+		MaxUses:   req.MaxUses,
+		CreatedAt: now,
+	}
+	if req.ExpiresAt != nil {
+		expiresAt := time.UnixMilli(*req.ExpiresAt)
+		if !expiresAt.After(now) {
+			writeError(w, http.StatusBadRequest, errors.New("expires_at must be in the future"))
+			return
+		}
+		registerToken.ExpiresAt = sql.NullTime{Time: expiresAt, Valid: true}
+	}
+	if req.MaxUses != nil && *req.MaxUses < 1 {
+		writeError(w, http.StatusBadRequest, errors.New("max_uses must be positive"))
+		return
+	}
+
+	if _, err := database().ExecContext(
+		ctx,
+		"INSERT INTO chair_register_tokens (id, owner_id, token, max_uses, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		registerToken.ID, registerToken.OwnerID, registerToken.Token, registerToken.MaxUses, registerToken.ExpiresAt, registerToken.CreatedAt,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newOwnerChairRegisterToken(registerToken))
+}
+
+type ownerGetChairRegisterTokensResponse struct {
+	Tokens []ownerChairRegisterToken `json:"tokens"`
+}
+
+func ownerGetChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	registerTokens := []ChairRegisterToken{}
+	if err := database().SelectContext(ctx, &registerTokens, "SELECT * FROM chair_register_tokens WHERE owner_id = ? ORDER BY created_at DESC", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairRegisterTokensResponse{Tokens: []ownerChairRegisterToken{}}
+	if len(registerTokens) == 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	tokenIDs := make([]string, 0, len(registerTokens))
+	for _, t := range registerTokens {
+		tokenIDs = append(tokenIDs, t.ID)
+	}
+	query, args, err := sqlx.In("SELECT * FROM chairs WHERE register_token_id IN (?) ORDER BY created_at", tokenIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairs := []Chair{}
+	if err := ridesDatabase().SelectContext(ctx, &chairs, query, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairsByToken := map[string][]ownerChairRegisterTokenChair{}
+	for _, chair := range chairs {
+		chairsByToken[chair.RegisterTokenID.String] = append(chairsByToken[chair.RegisterTokenID.String], ownerChairRegisterTokenChair{
+			ID:   chair.ID,
+			Name: chair.Name,
+		})
+	}
+
+	for i := range registerTokens {
+		t := newOwnerChairRegisterToken(&registerTokens[i])
+		if chairs, ok := chairsByToken[t.ID]; ok {
+			t.Chairs = chairs
+		}
+		res.Tokens = append(res.Tokens, t)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func ownerDeleteChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	tokenID := r.PathValue("token_id")
+
+	result, err := database().ExecContext(
+		ctx,
+		"UPDATE chair_register_tokens SET revoked_at = ? WHERE id = ? AND owner_id = ? AND revoked_at IS NULL",
+		time.Now(), tokenID, owner.ID,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("chair register token not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerGetFleetResponse struct {
+	Chairs      []ownerFleetChair `json:"chairs"`
+	RetrievedAt int64             `json:"retrieved_at"`
+}
+
+type ownerFleetChair struct {
+	ID                string           `json:"id"`
+	Name              string           `json:"name"`
+	Model             string           `json:"model"`
+	Active            bool             `json:"active"`
+	State             string           `json:"state"`
+	Coordinate        *Coordinate      `json:"coordinate"`
+	LocationUpdatedAt *int64           `json:"location_updated_at"`
+	SinceLastUpdateMs *int64           `json:"since_last_update_ms"`
+	Rides             []ownerFleetRide `json:"rides"`
+}
+
+type ownerFleetRide struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// 椅子ごとに、完了していないライドを古い順に返す
+// 相乗りでは 1 台が複数のライドを運ぶので、すべてを載せる
+func getActiveRidesByChair(ctx context.Context, chairs []Chair) (map[string][]ownerFleetRide, error) {
+	activeRides := map[string][]ownerFleetRide{}
+	if len(chairs) == 0 {
+		return activeRides, nil
+	}
+	chairIDs := make([]string, 0, len(chairs))
+	for _, chair := range chairs {
+		chairIDs = append(chairIDs, chair.ID)
+	}
+
+	query, args, err := sqlx.In(
+		`SELECT * FROM rides
+			WHERE chair_id IN (?)
+			AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED')
+			ORDER BY created_at`,
+		chairIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rides := []Ride{}
+	if err := ridesDatabase().SelectContext(ctx, &rides, query, args...); err != nil {
+		return nil, err
+	}
+	if len(rides) == 0 {
+		return activeRides, nil
+	}
+	rideIDs := make([]string, 0, len(rides))
+	for _, ride := range rides {
+		rideIDs = append(rideIDs, ride.ID)
+	}
+
+	query, args, err = sqlx.In(`SELECT * FROM ride_statuses WHERE ride_id IN (?) ORDER BY created_at`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []RideStatus{}
+	if err := ridesDatabase().SelectContext(ctx, &statuses, query, args...); err != nil {
+		return nil, err
+	}
+	latestStatuses := make(map[string]string, len(rides))
+	for _, s := range statuses {
+		latestStatuses[s.RideID] = s.Status
+	}
+
+	for _, ride := range rides {
+		activeRides[ride.ChairID.String] = append(activeRides[ride.ChairID.String], ownerFleetRide{ID: ride.ID, Status: latestStatuses[ride.ID]})
+	}
+	return activeRides, nil
+}
+
+func ownerGetFleet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairs := []Chair{}
+	if err := ridesDatabase().SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ? AND deleted_at IS NULL ORDER BY created_at", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	activeRides, err := getActiveRidesByChair(ctx, chairs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	res := ownerGetFleetResponse{
+		Chairs:      []ownerFleetChair{},
+		RetrievedAt: now.UnixMilli(),
+	}
+	for _, chair := range chairs {
+		c := ownerFleetChair{
+			ID:     chair.ID,
+			Name:   chair.Name,
+			Model:  chair.Model,
+			Active: chair.IsActive,
+			State:  chairState(chair.IsActive, chair.PendingDeactivation),
+			Rides:  []ownerFleetRide{},
+		}
+
+		location, err := getChairLocation(ctx, chair.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err == nil {
+			updatedAt := location.CreatedAt.UnixMilli()
+			sinceLastUpdate := now.Sub(location.CreatedAt).Milliseconds()
+			c.Coordinate = &Coordinate{Latitude: location.Latitude, Longitude: location.Longitude}
+			c.LocationUpdatedAt = &updatedAt
+			c.SinceLastUpdateMs = &sinceLastUpdate
+		}
+
+		if rides, ok := activeRides[chair.ID]; ok {
+			c.Rides = rides
+		}
+
+		res.Chairs = append(res.Chairs, c)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerFleetLocationEvent struct {
+	ChairID    string     `json:"chair_id"`
+	Coordinate Coordinate `json:"coordinate"`
+	RecordedAt int64      `json:"recorded_at"`
+}
+
+// 椅子の位置更新を Server-Sent Events で配信する
+func ownerGetFleetStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	locations, unsubscribe := fleetBroker.subscribe(owner.ID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case location := <-locations:
+			buf, err := json.Marshal(&ownerFleetLocationEvent{
+				ChairID:    location.ChairID,
+				Coordinate: Coordinate{Latitude: location.Latitude, Longitude: location.Longitude},
+				RecordedAt: location.CreatedAt.UnixMilli(),
+			})
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: location\ndata: %s\n\n", buf); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func ownerGetRideTrace(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	rideID := r.PathValue("ride_id")
+
+	ride := &Ride{}
+	if err := ridesDatabase().GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ride.ChairID.Valid {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	chair := &Chair{}
+	if err := ridesDatabase().GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID.String); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.OwnerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	segments, err := getRideTraceSegments(ctx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &getRideTraceResponse{
+		RideID:   ride.ID,
+		Segments: segments,
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/motoki317/sc"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	movementCheckOff    = "off"
+	movementCheckFlag   = "flag"
+	movementCheckReject = "reject"
+)
+
+// 不自然な移動を見つけたときの扱い
+// off: 何もしない / flag: 受け付けた上で記録する / reject: 記録してリクエストを拒否する
+var movementCheckMode = func() string {
+	switch mode := os.Getenv("ISUCON_MOVEMENT_CHECK_MODE"); mode {
+	case movementCheckOff, movementCheckReject:
+		return mode
+	default:
+		return movementCheckFlag
+	}
+}()
+
+// 椅子が chair_models.speed だけ進むのにかかる時間
+var chairMoveInterval = func() time.Duration {
+	ms := 1000
+	if vStr, exists := os.LookupEnv("ISUCON_CHAIR_MOVE_INTERVAL_MS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val > 0 {
+			ms = val
+		}
+	}
+	return time.Duration(ms) * time.Millisecond
+}()
+
+var chairModelSpeedCache, _ = sc.New(func(ctx context.Context, model string) (int, error) {
+	var speed int
+	err := ridesDatabase().GetContext(ctx, &speed, "SELECT speed FROM chair_models WHERE name = ?", model)
+	return speed, err
+}, 5*time.Minute, 5*time.Minute)
+
+type ChairSuspiciousEvent struct {
+	ID              string    `db:"id"`
+	ChairID         string    `db:"chair_id"`
+	OwnerID         string    `db:"owner_id"`
+	Kind            string    `db:"kind"`
+	Action          string    `db:"action"`
+	FromLatitude    int       `db:"from_latitude"`
+	FromLongitude   int       `db:"from_longitude"`
+	ToLatitude      int       `db:"to_latitude"`
+	ToLongitude     int       `db:"to_longitude"`
+	Distance        int       `db:"distance"`
+	ElapsedMs       int64     `db:"elapsed_ms"`
+	AllowedDistance int       `db:"allowed_distance"`
+	RecordedAt      time.Time `db:"recorded_at"`
+	CreatedAt       time.Time `db:"created_at"`
+}
+
+// 不自然な移動で拒否したときに返すエラー
+type implausibleMovementError struct {
+	events []*ChairSuspiciousEvent
+}
+
+func (e *implausibleMovementError) Error() string {
+	return fmt.Sprintf("implausible movement: %d suspicious points", len(e.events))
+}
+
+// 経過時間のうちに進める最大距離。送信と移動のずれを見込んで1回分の移動を余分に許す
+func allowedChairDistance(speed int, elapsed time.Duration) int {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return speed * (int(elapsed/chairMoveInterval) + 1)
+}
+
+// 直前の位置からの移動がモデルの速度で説明できなければ記録用のイベントを返す
+func checkChairMovement(chair *ChairOnlyNoChange, speed int, from Coordinate, fromAt time.Time, to Coordinate, toAt time.Time) *ChairSuspiciousEvent {
+	if movementCheckMode == movementCheckOff {
+		return nil
+	}
+	distance := calculateDistance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	elapsed := toAt.Sub(fromAt)
+	allowed := allowedChairDistance(speed, elapsed)
+	if distance <= allowed {
+		return nil
+	}
+	action := "flagged"
+	if movementCheckMode == movementCheckReject {
+		action = "rejected"
+	}
+	return &ChairSuspiciousEvent{
+		ID:              ulid.Make().String(),
+		ChairID:         chair.ID,
+		OwnerID:         chair.OwnerID,
+		Kind:            "speed",
+		Action:          action,
+		FromLatitude:    from.Latitude,
+		FromLongitude:   from.Longitude,
+		ToLatitude:      to.Latitude,
+		ToLongitude:     to.Longitude,
+		Distance:        distance,
+		ElapsedMs:       elapsed.Milliseconds(),
+		AllowedDistance: allowed,
+		RecordedAt:      toAt,
+	}
+}
+
+func insertChairSuspiciousEvents(ctx context.Context, db sqlx.ExtContext, events []*ChairSuspiciousEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	_, err := sqlx.NamedExecContext(
+		ctx,
+		db,
+		`INSERT INTO chair_suspicious_events (id, chair_id, owner_id, kind, action, from_latitude, from_longitude, to_latitude, to_longitude, distance, elapsed_ms, allowed_distance, recorded_at)
+			VALUES (:id, :chair_id, :owner_id, :kind, :action, :from_latitude, :from_longitude, :to_latitude, :to_longitude, :distance, :elapsed_ms, :allowed_distance, :recorded_at)`,
+		events,
+	)
+	return err
+}
+
+// 座標の記録で出たエラーをレスポンスにする
+// 拒否した場合はトランザクションの外でイベントだけ残す
+func writeChairCoordinatesError(ctx context.Context, w http.ResponseWriter, err error) {
+	var implausible *implausibleMovementError
+	if errors.As(err, &implausible) {
+		if err := insertChairSuspiciousEvents(ctx, database(), implausible.events); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+type suspiciousEventResponse struct {
+	ID              string     `json:"id"`
+	ChairID         string     `json:"chair_id"`
+	OwnerID         string     `json:"owner_id"`
+	Kind            string     `json:"kind"`
+	Action          string     `json:"action"`
+	From            Coordinate `json:"from"`
+	To              Coordinate `json:"to"`
+	Distance        int        `json:"distance"`
+	ElapsedMs       int64      `json:"elapsed_ms"`
+	AllowedDistance int        `json:"allowed_distance"`
+	RecordedAt      int64      `json:"recorded_at"`
+}
+
+type getSuspiciousEventsResponse struct {
+	Events []suspiciousEventResponse `json:"events"`
+}
+
+const defaultSuspiciousEventsLimit = 100
+
+// chair_id, since, limit で絞り込んで新しい順に返す
+// ownerID が空ならすべてのオーナーのイベントを対象にする
+func getSuspiciousEvents(ctx context.Context, r *http.Request, ownerID string) (*getSuspiciousEventsResponse, error) {
+	query := `SELECT * FROM chair_suspicious_events WHERE 1 = 1`
+	args := []any{}
+	if ownerID != "" {
+		query += ` AND owner_id = ?`
+		args = append(args, ownerID)
+	}
+	if chairID := r.URL.Query().Get("chair_id"); chairID != "" {
+		query += ` AND chair_id = ?`
+		args = append(args, chairID)
+	}
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			return nil, errBadQuery
+		}
+		query += ` AND recorded_at >= ?`
+		args = append(args, time.UnixMilli(since))
+	}
+	limit := defaultSuspiciousEventsLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > 1000 {
+			return nil, errBadQuery
+		}
+		limit = l
+	}
+	query += ` ORDER BY recorded_at DESC, id DESC LIMIT ?`
+	args = append(args, limit)
+
+	events := []ChairSuspiciousEvent{}
+	if err := database().SelectContext(ctx, &events, query, args...); err != nil {
+		return nil, err
+	}
+
+	res := &getSuspiciousEventsResponse{Events: []suspiciousEventResponse{}}
+	for _, e := range events {
+		res.Events = append(res.Events, suspiciousEventResponse{
+			ID:              e.ID,
+			ChairID:         e.ChairID,
+			OwnerID:         e.OwnerID,
+			Kind:            e.Kind,
+			Action:          e.Action,
+			From:            Coordinate{Latitude: e.FromLatitude, Longitude: e.FromLongitude},
+			To:              Coordinate{Latitude: e.ToLatitude, Longitude: e.ToLongitude},
+			Distance:        e.Distance,
+			ElapsedMs:       e.ElapsedMs,
+			AllowedDistance: e.AllowedDistance,
+			RecordedAt:      e.RecordedAt.UnixMilli(),
+		})
+	}
+	return res, nil
+}
+
+var errBadQuery = errors.New("invalid query parameter")
+
+func ownerGetSuspiciousEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	res, err := getSuspiciousEvents(ctx, r, owner.ID)
+	if err != nil {
+		if errors.Is(err, errBadQuery) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func operatorGetSuspiciousEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := getSuspiciousEvents(ctx, r, "")
+	if err != nil {
+		if errors.Is(err, errBadQuery) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 相乗りを選んだライドの距離料金の割引率(%)
+var pooledDiscountPercent = func() int {
+	percent := 20
+	if vStr, exists := os.LookupEnv("ISUCON_POOLED_DISCOUNT_PERCENT"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val >= 0 && val <= 100 {
+			percent = val
+		}
+	}
+	return percent
+}()
+
+// 相乗りで乗車中の距離が単独で乗る場合と比べてどこまで伸びてよいか(%)
+var poolMaxDetourPercent = func() int {
+	percent := 50
+	if vStr, exists := os.LookupEnv("ISUCON_POOL_MAX_DETOUR_PERCENT"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val >= 0 {
+			percent = val
+		}
+	}
+	return percent
+}()
+
+// 1台の椅子に同時に割り当てられる相乗りライドの数
+const maxPooledRidesPerChair = 2
+
+// 椅子に割り当てられていて、まだ COMPLETED になっていないライドを古い順に返す
+func getChairActiveRides(ctx context.Context, q sqlx.QueryerContext, chairID string) ([]Ride, error) {
+	rides := []Ride{}
+	if err := sqlx.SelectContext(
+		ctx,
+		q,
+		&rides,
+		`SELECT * FROM rides
+			WHERE chair_id = ?
+			AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED')
+			ORDER BY created_at`,
+		chairID,
+	); err != nil {
+		return nil, err
+	}
+	return rides, nil
+}
+
+type poolWaypoint struct {
+	RideID     string     `json:"ride_id"`
+	Kind       string     `json:"kind"`
+	Coordinate Coordinate `json:"coordinate"`
+}
+
+// 相乗りの候補となる、すでに椅子に割り当てられたライド
+type poolCandidate struct {
+	ride Ride
+	// 乗車済みなら配車位置は回らない
+	pickedUp bool
+}
+
+// 椅子の現在位置から、割り当て済みのライドと新しいライドを両方運ぶ経路のうち最短のものを返す
+// どちらの乗客も、乗車中の距離が単独で乗る場合の poolMaxDetourPercent を超えて伸びる経路は選ばない
+// 経路が見つからなければ ok = false
+func planPooledRoute(start Coordinate, existing poolCandidate, ride Ride) (route []poolWaypoint, cost int, ok bool) {
+	waypoints := []poolWaypoint{}
+	if !existing.pickedUp {
+		waypoints = append(waypoints, poolWaypoint{RideID: existing.ride.ID, Kind: "pickup", Coordinate: Coordinate{Latitude: existing.ride.PickupLatitude, Longitude: existing.ride.PickupLongitude}})
+	}
+	waypoints = append(waypoints,
+		poolWaypoint{RideID: existing.ride.ID, Kind: "dropoff", Coordinate: Coordinate{Latitude: existing.ride.DestinationLatitude, Longitude: existing.ride.DestinationLongitude}},
+		poolWaypoint{RideID: ride.ID, Kind: "pickup", Coordinate: Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}},
+		poolWaypoint{RideID: ride.ID, Kind: "dropoff", Coordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}},
+	)
+
+	// 単独で乗る場合の乗車中の距離。乗車済みの乗客は現在位置から目的地まで
+	direct := map[string]int{
+		ride.ID: calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude),
+	}
+	if existing.pickedUp {
+		direct[existing.ride.ID] = calculateDistance(start.Latitude, start.Longitude, existing.ride.DestinationLatitude, existing.ride.DestinationLongitude)
+	} else {
+		direct[existing.ride.ID] = calculateDistance(existing.ride.PickupLatitude, existing.ride.PickupLongitude, existing.ride.DestinationLatitude, existing.ride.DestinationLongitude)
+	}
+
+	best := -1
+	permuteWaypoints(waypoints, 0, func(order []poolWaypoint) {
+		total := 0
+		boardedAt := map[string]int{}
+		if existing.pickedUp {
+			boardedAt[existing.ride.ID] = 0
+		}
+		at := start
+		for _, w := range order {
+			if w.Kind == "dropoff" {
+				if _, ok := boardedAt[w.RideID]; !ok {
+					// 乗せる前に降ろす順番は選べない
+					return
+				}
+			}
+			total += calculateDistance(at.Latitude, at.Longitude, w.Coordinate.Latitude, w.Coordinate.Longitude)
+			at = w.Coordinate
+			switch w.Kind {
+			case "pickup":
+				boardedAt[w.RideID] = total
+			case "dropoff":
+				onBoard := total - boardedAt[w.RideID]
+				if onBoard*100 > direct[w.RideID]*(100+poolMaxDetourPercent) {
+					return
+				}
+			}
+		}
+		if best < 0 || total < best {
+			best = total
+			route = append([]poolWaypoint{}, order...)
+		}
+	})
+	if best < 0 {
+		return nil, 0, false
+	}
+
+	// 割り当て済みのライドだけを運ぶ場合と比べて増える距離を相乗りのコストとする
+	alone := calculateDistance(start.Latitude, start.Longitude, existing.ride.DestinationLatitude, existing.ride.DestinationLongitude)
+	if !existing.pickedUp {
+		alone = calculateDistance(start.Latitude, start.Longitude, existing.ride.PickupLatitude, existing.ride.PickupLongitude) + direct[existing.ride.ID]
+	}
+	return route, best - alone, true
+}
+
+func permuteWaypoints(waypoints []poolWaypoint, k int, visit func([]poolWaypoint)) {
+	if k == len(waypoints) {
+		visit(waypoints)
+		return
+	}
+	for i := k; i < len(waypoints); i++ {
+		waypoints[k], waypoints[i] = waypoints[i], waypoints[k]
+		permuteWaypoints(waypoints, k+1, visit)
+		waypoints[k], waypoints[i] = waypoints[i], waypoints[k]
+	}
+}
+
+// 相乗りの候補として調べる、割り当て済みのライドの数
+const poolCandidateLimit = 20
+
+type pooledRideCandidate struct {
+	Ride
+	ChairModel   string `db:"chair_model"`
+	LatestStatus string `db:"latest_status"`
+}
+
+// 相乗りのライドを、すでに相乗りのライドを1件だけ運んでいる椅子に相乗りさせる
+// 相乗りのコストが最も小さい椅子と、その椅子が回る順番を返す。見つからなければ空文字列
+// allowedModels が nil でなければ、そのモデルの椅子だけを候補にする
+func findPooledChair(ctx context.Context, ride *Ride, allowedModels map[string]bool) (string, []poolWaypoint, error) {
+	// 乗車位置と目的地が近いライドから順に、空きのある椅子のものだけを調べる
+	query := `SELECT rides.*, chairs.model AS chair_model,
+			(SELECT status FROM ride_statuses WHERE ride_statuses.ride_id = rides.id ORDER BY created_at DESC LIMIT 1) AS latest_status
+		FROM rides
+		JOIN chairs ON chairs.id = rides.chair_id
+		WHERE rides.pooled = TRUE
+		AND chairs.is_active = TRUE AND chairs.pending_deactivation = FALSE
+		AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status IN ('ARRIVED', 'COMPLETED'))
+		AND rides.chair_id IN (
+			SELECT active.chair_id FROM rides AS active
+			WHERE active.chair_id IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = active.id AND ride_statuses.status = 'COMPLETED')
+			GROUP BY active.chair_id
+			HAVING COUNT(*) < ?
+		)`
+	args := []any{maxPooledRidesPerChair}
+	if allowedModels != nil {
+		models := make([]string, 0, len(allowedModels))
+		for m := range allowedModels {
+			models = append(models, m)
+		}
+		query += " AND chairs.model IN (?)"
+		args = append(args, models)
+	}
+	query += ` ORDER BY ABS(rides.pickup_latitude - ?) + ABS(rides.pickup_longitude - ?) + ABS(rides.destination_latitude - ?) + ABS(rides.destination_longitude - ?)
+		LIMIT ?`
+	args = append(args, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, poolCandidateLimit)
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	candidates := []pooledRideCandidate{}
+	if err := ridesDatabase().SelectContext(ctx, &candidates, query, args...); err != nil {
+		return "", nil, err
+	}
+
+	bestChairID, bestCost := "", -1
+	var bestRoute []poolWaypoint
+	for _, candidate := range candidates {
+		canServe, err := canChairServeRide(ctx, candidate.ChairID.String, ride)
+		if err != nil {
+			return "", nil, err
+		}
+		if !canServe {
+			continue
+		}
+
+		location, err := getChairLocation(ctx, candidate.ChairID.String)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return "", nil, err
+		}
+		route, cost, ok := planPooledRoute(
+			Coordinate{Latitude: location.Latitude, Longitude: location.Longitude},
+			poolCandidate{ride: candidate.Ride, pickedUp: candidate.LatestStatus == "PICKUP" || candidate.LatestStatus == "CARRYING"},
+			*ride,
+		)
+		if ok && (bestCost < 0 || cost < bestCost) {
+			bestChairID, bestCost, bestRoute = candidate.ChairID.String, cost, route
+		}
+	}
+	return bestChairID, bestRoute, nil
+}
+
+type chairPoolRoute struct {
+	ChairID   string `db:"chair_id"`
+	Seq       int    `db:"seq"`
+	RideID    string `db:"ride_id"`
+	Kind      string `db:"kind"`
+	Latitude  int    `db:"latitude"`
+	Longitude int    `db:"longitude"`
+}
+
+// 相乗りを割り当てた椅子に、迂回の上限を確かめた順番を記録する
+func saveChairPoolRoute(ctx context.Context, ridesTx *sqlx.Tx, chairID string, route []poolWaypoint) error {
+	if _, err := ridesTx.ExecContext(ctx, "DELETE FROM chair_pool_routes WHERE chair_id = ?", chairID); err != nil {
+		return err
+	}
+	rows := make([]chairPoolRoute, 0, len(route))
+	for i, w := range route {
+		rows = append(rows, chairPoolRoute{
+			ChairID:   chairID,
+			Seq:       i + 1,
+			RideID:    w.RideID,
+			Kind:      w.Kind,
+			Latitude:  w.Coordinate.Latitude,
+			Longitude: w.Coordinate.Longitude,
+		})
+	}
+	if len(rows) > 0 {
+		if _, err := ridesTx.NamedExecContext(
+			ctx,
+			"INSERT INTO chair_pool_routes (chair_id, seq, ride_id, kind, latitude, longitude) VALUES (:chair_id, :seq, :ride_id, :kind, :latitude, :longitude)",
+			rows,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 椅子がこれから回る相乗りの乗車・降車位置を順番に返す
+// 乗客が乗った後の乗車位置と、到着した後の降車位置は除く
+func getChairPoolRoute(ctx context.Context, ridesTx *sqlx.Tx, chairID string, activeRides []Ride) ([]poolWaypoint, error) {
+	statuses := make(map[string]string, len(activeRides))
+	for _, r := range activeRides {
+		status, err := getLatestRideStatus(ctx, ridesTx, r.ID)
+		if err != nil {
+			return nil, err
+		}
+		statuses[r.ID] = status
+	}
+
+	rows := []chairPoolRoute{}
+	if err := ridesTx.SelectContext(ctx, &rows, "SELECT * FROM chair_pool_routes WHERE chair_id = ? ORDER BY seq", chairID); err != nil {
+		return nil, err
+	}
+	route := []poolWaypoint{}
+	for _, row := range rows {
+		status, ok := statuses[row.RideID]
+		if !ok {
+			continue
+		}
+		switch row.Kind {
+		case "pickup":
+			if status != "MATCHING" && status != "ENROUTE" && status != "PICKUP" {
+				continue
+			}
+		case "dropoff":
+			if status == "ARRIVED" {
+				continue
+			}
+		}
+		route = append(route, poolWaypoint{
+			RideID:     row.RideID,
+			Kind:       row.Kind,
+			Coordinate: Coordinate{Latitude: row.Latitude, Longitude: row.Longitude},
+		})
+	}
+	return route, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+type RidePayment struct {
+	RideID    string    `db:"ride_id"`
+	Reference string    `db:"reference"`
+	Amount    int       `db:"amount"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// 決済サービスは支払いを識別する値を返さないので、こちらで支払い番号を振って記録する
+// 決済に失敗したらトランザクションごと取り消すこと
+func insertRidePayment(ctx context.Context, ridesTx *sqlx.Tx, rideID string, amount int) error {
+	_, err := ridesTx.ExecContext(
+		ctx,
+		"INSERT INTO ride_payments (ride_id, reference, amount) VALUES (?, ?, ?)",
+		rideID, ulid.Make().String(), amount,
+	)
+	return err
+}
+
+type appGetRideReceiptResponse struct {
+	RideID                string     `json:"ride_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Distance              int        `json:"distance"`
+	BaseFare              int        `json:"base_fare"`
+	DistanceCharge        int        `json:"distance_charge"`
+	CouponDiscount        int        `json:"coupon_discount"`
+	ChargedAmount         int        `json:"charged_amount"`
+	// 支払いの記録を始める前に完了したライドには無い
+	PaymentReference *string `json:"payment_reference"`
+	ChairName        string  `json:"chair_name"`
+	ChairModel       string  `json:"chair_model"`
+	OwnerName        string  `json:"owner_name"`
+	RequestedAt      int64   `json:"requested_at"`
+	CompletedAt      int64   `json:"completed_at"`
+	PaidAt           *int64  `json:"paid_at"`
+}
+
+// テンプレートで日時を表示するためのもの
+func formatReceiptTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+func (r *appGetRideReceiptResponse) RequestedAtText() string {
+	return formatReceiptTime(r.RequestedAt)
+}
+
+func (r *appGetRideReceiptResponse) CompletedAtText() string {
+	return formatReceiptTime(r.CompletedAt)
+}
+
+func (r *appGetRideReceiptResponse) PaidAtText() string {
+	if r.PaidAt == nil {
+		return ""
+	}
+	return formatReceiptTime(*r.PaidAt)
+}
+
+const rideReceiptText = `領収書
+
+ライドID: {{.RideID}}
+{{if .PaymentReference}}支払い番号: {{.PaymentReference}}
+{{end}}
+配車日時: {{.RequestedAtText}}
+到着日時: {{.CompletedAtText}}
+{{if .PaidAt}}支払い日時: {{.PaidAtText}}
+{{end}}
+椅子: {{.ChairName}} ({{.ChairModel}})
+オーナー: {{.OwnerName}}
+乗車位置: ({{.PickupCoordinate.Latitude}}, {{.PickupCoordinate.Longitude}})
+目的地: ({{.DestinationCoordinate.Latitude}}, {{.DestinationCoordinate.Longitude}})
+距離: {{.Distance}}
+
+初乗り運賃: {{.BaseFare}}円
+距離料金: {{.DistanceCharge}}円
+クーポン割引: -{{.CouponDiscount}}円
+お支払い金額: {{.ChargedAmount}}円
+`
+
+const rideReceiptHTML = `<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>領収書 {{.RideID}}</title>
+</head>
+<body>
+<h1>領収書</h1>
+<table>
+<tr><th>ライドID</th><td>{{.RideID}}</td></tr>
+{{if .PaymentReference}}<tr><th>支払い番号</th><td>{{.PaymentReference}}</td></tr>
+{{end}}<tr><th>配車日時</th><td>{{.RequestedAtText}}</td></tr>
+<tr><th>到着日時</th><td>{{.CompletedAtText}}</td></tr>
+{{if .PaidAt}}<tr><th>支払い日時</th><td>{{.PaidAtText}}</td></tr>
+{{end}}<tr><th>椅子</th><td>{{.ChairName}} ({{.ChairModel}})</td></tr>
+<tr><th>オーナー</th><td>{{.OwnerName}}</td></tr>
+<tr><th>乗車位置</th><td>({{.PickupCoordinate.Latitude}}, {{.PickupCoordinate.Longitude}})</td></tr>
+<tr><th>目的地</th><td>({{.DestinationCoordinate.Latitude}}, {{.DestinationCoordinate.Longitude}})</td></tr>
+<tr><th>距離</th><td>{{.Distance}}</td></tr>
+</table>
+<table>
+<tr><th>初乗り運賃</th><td>{{.BaseFare}}円</td></tr>
+<tr><th>距離料金</th><td>{{.DistanceCharge}}円</td></tr>
+<tr><th>クーポン割引</th><td>-{{.CouponDiscount}}円</td></tr>
+<tr><th>お支払い金額</th><td>{{.ChargedAmount}}円</td></tr>
+</table>
+</body>
+</html>
+`
+
+var (
+	rideReceiptTextTemplate = texttemplate.Must(texttemplate.New("receipt").Parse(rideReceiptText))
+	rideReceiptHTMLTemplate = htmltemplate.Must(htmltemplate.New("receipt").Parse(rideReceiptHTML))
+)
+
+// format に json (既定), text, html を指定できる
+func appGetRideReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	rideID := r.PathValue("ride_id")
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "text" && format != "html" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be json, text or html"))
+		return
+	}
+
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	ride := Ride{}
+	if err := ridesTx.GetContext(ctx, &ride, `SELECT * FROM rides WHERE id = ? AND user_id = ?`, rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != "COMPLETED" {
+		writeError(w, http.StatusBadRequest, errors.New("ride is not completed"))
+		return
+	}
+
+	details, err := loadRideHistoryDetails(ctx, tx, ridesTx, []Ride{ride})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var payment *RidePayment
+	p := &RidePayment{}
+	if err := ridesTx.GetContext(ctx, p, `SELECT * FROM ride_payments WHERE ride_id = ?`, ride.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		payment = p
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	quote := quoteForRide(ride)
+	breakdown := newFareBreakdown(quote, details.couponDiscounts[ride.ID])
+	receipt := &appGetRideReceiptResponse{
+		RideID:                ride.ID,
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Distance:              quote.Distance,
+		BaseFare:              breakdown.InitialFare,
+		DistanceCharge:        meteredFare(quote),
+		CouponDiscount:        breakdown.CouponDiscount,
+		ChargedAmount:         breakdown.Total,
+		RequestedAt:           ride.CreatedAt.UnixMilli(),
+		CompletedAt:           ride.UpdatedAt.UnixMilli(),
+	}
+	// updated_at は評価・支払いの日時なので、目的地に着いた日時には ARRIVED の日時を使う
+	if arrivedAt := details.arrivedAt(ride.ID); arrivedAt != nil {
+		receipt.CompletedAt = *arrivedAt
+	}
+	if chair := details.chair(ride); chair != nil {
+		receipt.ChairName = chair.Name
+		receipt.ChairModel = chair.Model
+		receipt.OwnerName = chair.Owner
+	}
+	if payment != nil {
+		paidAt := payment.CreatedAt.UnixMilli()
+		receipt.PaymentReference = &payment.Reference
+		receipt.ChargedAmount = payment.Amount
+		receipt.PaidAt = &paidAt
+	}
+
+	switch format {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := rideReceiptTextTemplate.Execute(w, receipt); err != nil {
+			slog.Error("failed to render receipt", "ride_id", ride.ID, "err", err)
+		}
+	case "html":
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := rideReceiptHTMLTemplate.Execute(w, receipt); err != nil {
+			slog.Error("failed to render receipt", "ride_id", ride.ID, "err", err)
+		}
+	default:
+		writeJSON(w, http.StatusOK, receipt)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 利用者が評価に付けられるタグ
+var rideReviewTags = map[string]bool{
+	"clean": true,
+	"fast":  true,
+	"rude":  true,
+	"late":  true,
+}
+
+// コメントは運営が承認するまでオーナーには見せない
+const (
+	reviewModerationPending  = "pending"
+	reviewModerationApproved = "approved"
+	reviewModerationRejected = "rejected"
+)
+
+const maxReviewCommentLength = 1000
+
+type RideReview struct {
+	RideID           string    `db:"ride_id"`
+	ChairID          string    `db:"chair_id"`
+	UserID           string    `db:"user_id"`
+	Comment          string    `db:"comment"`
+	ModerationStatus string    `db:"moderation_status"`
+	CreatedAt        time.Time `db:"created_at"`
+	UpdatedAt        time.Time `db:"updated_at"`
+}
+
+func validateRideReview(comment string, tags []string) error {
+	if utf8.RuneCountInString(comment) > maxReviewCommentLength {
+		return fmt.Errorf("comment is too long (max %d characters)", maxReviewCommentLength)
+	}
+	for _, tag := range tags {
+		if !rideReviewTags[tag] {
+			return fmt.Errorf("invalid tag: %s", tag)
+		}
+	}
+	return nil
+}
+
+// コメントもタグも無ければレビューは作らない
+// コメントの無いレビューは審査するものが無いので承認済みにする
+func insertRideReview(ctx context.Context, ridesTx *sqlx.Tx, ride *Ride, comment string, tags []string) error {
+	if comment == "" && len(tags) == 0 {
+		return nil
+	}
+	status := reviewModerationApproved
+	if comment != "" {
+		status = reviewModerationPending
+	}
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		"INSERT INTO ride_reviews (ride_id, chair_id, user_id, comment, moderation_status) VALUES (?, ?, ?, ?, ?)",
+		ride.ID, ride.ChairID.String, ride.UserID, comment, status,
+	); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := ridesTx.ExecContext(ctx, "INSERT IGNORE INTO ride_review_tags (ride_id, tag) VALUES (?, ?)", ride.ID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 却下されたレビューのタグは数えない
+func getChairReviewTagCounts(ctx context.Context, q sqlx.QueryerContext, chairID string) (map[string]int, error) {
+	type tagCount struct {
+		Tag   string `db:"tag"`
+		Count int    `db:"count"`
+	}
+	rows := []tagCount{}
+	if err := sqlx.SelectContext(ctx, q, &rows, `
+		SELECT ride_review_tags.tag, COUNT(*) AS count
+		FROM ride_reviews
+		JOIN ride_review_tags ON ride_review_tags.ride_id = ride_reviews.ride_id
+		WHERE ride_reviews.chair_id = ? AND ride_reviews.moderation_status != ?
+		GROUP BY ride_review_tags.tag
+	`, chairID, reviewModerationRejected); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Tag] = row.Count
+	}
+	return counts, nil
+}
+
+type reviewResponse struct {
+	RideID           string   `json:"ride_id"`
+	ChairID          string   `json:"chair_id"`
+	ChairName        string   `json:"chair_name"`
+	Evaluation       *int     `json:"evaluation"`
+	Comment          string   `json:"comment"`
+	Tags             []string `json:"tags"`
+	ModerationStatus string   `json:"moderation_status"`
+	CreatedAt        int64    `json:"created_at"`
+}
+
+type getReviewsResponse struct {
+	Reviews []reviewResponse `json:"reviews"`
+}
+
+const defaultReviewsLimit = 100
+
+// chair_id, tag, moderation_status, min_evaluation, max_evaluation, limit で絞り込んで新しい順に返す
+// ownerID が空ならすべてのオーナーの椅子のレビューを対象にし、審査前のコメントも返す
+func getReviews(ctx context.Context, r *http.Request, ownerID string) (*getReviewsResponse, error) {
+	query := `
+		SELECT ride_reviews.*, chairs.name AS chair_name, rides.evaluation
+		FROM ride_reviews
+		JOIN chairs ON chairs.id = ride_reviews.chair_id
+		JOIN rides ON rides.id = ride_reviews.ride_id
+		WHERE 1 = 1`
+	args := []any{}
+	if ownerID != "" {
+		query += ` AND chairs.owner_id = ?`
+		args = append(args, ownerID)
+	}
+	if chairID := r.URL.Query().Get("chair_id"); chairID != "" {
+		query += ` AND ride_reviews.chair_id = ?`
+		args = append(args, chairID)
+	}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		if !rideReviewTags[tag] {
+			return nil, errBadQuery
+		}
+		query += ` AND EXISTS (SELECT 1 FROM ride_review_tags WHERE ride_review_tags.ride_id = ride_reviews.ride_id AND ride_review_tags.tag = ?)`
+		args = append(args, tag)
+	}
+	if status := r.URL.Query().Get("moderation_status"); status != "" {
+		if status != reviewModerationPending && status != reviewModerationApproved && status != reviewModerationRejected {
+			return nil, errBadQuery
+		}
+		query += ` AND ride_reviews.moderation_status = ?`
+		args = append(args, status)
+	}
+	for param, op := range map[string]string{"min_evaluation": ">=", "max_evaluation": "<="} {
+		if vStr := r.URL.Query().Get(param); vStr != "" {
+			v, err := strconv.Atoi(vStr)
+			if err != nil || v < 1 || v > 5 {
+				return nil, errBadQuery
+			}
+			query += ` AND rides.evaluation ` + op + ` ?`
+			args = append(args, v)
+		}
+	}
+	limit := defaultReviewsLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > 1000 {
+			return nil, errBadQuery
+		}
+		limit = l
+	}
+	query += ` ORDER BY ride_reviews.created_at DESC, ride_reviews.ride_id DESC LIMIT ?`
+	args = append(args, limit)
+
+	type reviewWithRide struct {
+		RideReview
+		ChairName  string `db:"chair_name"`
+		Evaluation *int   `db:"evaluation"`
+	}
+	reviews := []reviewWithRide{}
+	if err := ridesDatabase().SelectContext(ctx, &reviews, query, args...); err != nil {
+		return nil, err
+	}
+
+	res := &getReviewsResponse{Reviews: []reviewResponse{}}
+	if len(reviews) == 0 {
+		return res, nil
+	}
+
+	rideIDs := make([]string, 0, len(reviews))
+	for _, review := range reviews {
+		rideIDs = append(rideIDs, review.RideID)
+	}
+	tagQuery, tagArgs, err := sqlx.In("SELECT ride_id, tag FROM ride_review_tags WHERE ride_id IN (?) ORDER BY tag", rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	tagRows := []struct {
+		RideID string `db:"ride_id"`
+		Tag    string `db:"tag"`
+	}{}
+	if err := ridesDatabase().SelectContext(ctx, &tagRows, tagQuery, tagArgs...); err != nil {
+		return nil, err
+	}
+	tags := map[string][]string{}
+	for _, row := range tagRows {
+		tags[row.RideID] = append(tags[row.RideID], row.Tag)
+	}
+
+	for _, review := range reviews {
+		comment := review.Comment
+		if ownerID != "" && review.ModerationStatus != reviewModerationApproved {
+			comment = ""
+		}
+		reviewTags := tags[review.RideID]
+		if reviewTags == nil {
+			reviewTags = []string{}
+		}
+		res.Reviews = append(res.Reviews, reviewResponse{
+			RideID:           review.RideID,
+			ChairID:          review.ChairID,
+			ChairName:        review.ChairName,
+			Evaluation:       review.Evaluation,
+			Comment:          comment,
+			Tags:             reviewTags,
+			ModerationStatus: review.ModerationStatus,
+			CreatedAt:        review.CreatedAt.UnixMilli(),
+		})
+	}
+	return res, nil
+}
+
+func ownerGetReviews(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	res, err := getReviews(ctx, r, owner.ID)
+	if err != nil {
+		if errors.Is(err, errBadQuery) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func operatorGetReviews(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res, err := getReviews(ctx, r, "")
+	if err != nil {
+		if errors.Is(err, errBadQuery) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type operatorPatchReviewRequest struct {
+	ModerationStatus string `json:"moderation_status"`
+}
+
+func operatorPatchReview(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	req := &operatorPatchReviewRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.ModerationStatus != reviewModerationApproved && req.ModerationStatus != reviewModerationRejected {
+		writeError(w, http.StatusBadRequest, errors.New("moderation_status must be approved or rejected"))
+		return
+	}
+
+	result, err := ridesDatabase().ExecContext(ctx, "UPDATE ride_reviews SET moderation_status = ? WHERE ride_id = ?", req.ModerationStatus, rideID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		// 同じ状態への更新も 0 件になるので、存在を確かめてから 404 にする
+		var exists bool
+		if err := ridesDatabase().GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM ride_reviews WHERE ride_id = ?)", rideID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, errors.New("review not found"))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
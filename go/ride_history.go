@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	defaultRideHistoryLimit = 20
+	maxRideHistoryLimit     = 100
+)
+
+var rideStatuses = map[string]bool{
+	"MATCHING":  true,
+	"ENROUTE":   true,
+	"PICKUP":    true,
+	"CARRYING":  true,
+	"ARRIVED":   true,
+	"COMPLETED": true,
+}
+
+// 支払いは評価と同時に行われ、失敗すると COMPLETED にならない
+const (
+	paymentStateNotDue = "not_due"
+	paymentStateDue    = "due"
+	paymentStatePaid   = "paid"
+)
+
+func paymentStateForStatus(status string) string {
+	switch status {
+	case "COMPLETED":
+		return paymentStatePaid
+	case "ARRIVED":
+		return paymentStateDue
+	default:
+		return paymentStateNotDue
+	}
+}
+
+type rideWithLatestStatus struct {
+	Ride
+	LatestStatus string `db:"latest_status"`
+}
+
+// cursor (前のページの最後のライドID), since, until, status, limit で絞り込んで新しい順に返す
+// status を省略すると完了したライドだけを返す
+// cursor も limit も無ければ従来どおりすべて返す。どちらかがあれば limit 件ずつ返し、残っていれば次のページの cursor も返す
+func getUserRideHistory(ctx context.Context, ridesTx *sqlx.Tx, r *http.Request, userID string) ([]rideWithLatestStatus, string, error) {
+	query := `SELECT rides.*, (SELECT status FROM ride_statuses WHERE ride_statuses.ride_id = rides.id ORDER BY created_at DESC LIMIT 1) AS latest_status
+		FROM rides WHERE user_id = ?`
+	args := []any{userID}
+	cursor := r.URL.Query().Get("cursor")
+	if cursor != "" {
+		if _, err := ulid.ParseStrict(cursor); err != nil {
+			return nil, "", errBadQuery
+		}
+		query += ` AND (created_at, id) < ((SELECT created_at FROM rides WHERE id = ? AND user_id = ?), ?)`
+		args = append(args, cursor, userID, cursor)
+	}
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		if vStr := r.URL.Query().Get(param); vStr != "" {
+			v, err := strconv.ParseInt(vStr, 10, 64)
+			if err != nil {
+				return nil, "", errBadQuery
+			}
+			query += ` AND created_at ` + op + ` ?`
+			args = append(args, time.UnixMilli(v))
+		}
+	}
+
+	statuses := []string{"COMPLETED"}
+	if statusStr := r.URL.Query().Get("status"); statusStr != "" {
+		statuses = strings.Split(statusStr, ",")
+		for _, s := range statuses {
+			if !rideStatuses[s] {
+				return nil, "", errBadQuery
+			}
+		}
+	}
+
+	limitStr := r.URL.Query().Get("limit")
+	paginated := cursor != "" || limitStr != ""
+	limit := defaultRideHistoryLimit
+	if limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > maxRideHistoryLimit {
+			return nil, "", errBadQuery
+		}
+		limit = l
+	}
+
+	query = `SELECT * FROM (` + query + `) AS history WHERE latest_status IN (?) ORDER BY created_at DESC, id DESC`
+	args = append(args, statuses)
+	if paginated {
+		query += ` LIMIT ?`
+		args = append(args, limit+1)
+	}
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	rides := []rideWithLatestStatus{}
+	if err := ridesTx.SelectContext(ctx, &rides, query, args...); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if paginated && len(rides) > limit {
+		rides = rides[:limit]
+		nextCursor = rides[limit-1].ID
+	}
+	return rides, nextCursor, nil
+}
+
+// 履歴の各ライドに必要なものをまとめて取得したもの
+type rideHistoryDetails struct {
+	chairs          map[string]*Chair
+	owners          map[string]*Owner
+	statuses        map[string][]RideStatus
+	metrics         map[string]*RideMetrics
+	stops           map[string][]RideStop
+	couponDiscounts map[string]int
+}
+
+func loadRideHistoryDetails(ctx context.Context, tx *sqlx.Tx, ridesTx *sqlx.Tx, rides []Ride) (*rideHistoryDetails, error) {
+	details := &rideHistoryDetails{
+		chairs:          map[string]*Chair{},
+		owners:          map[string]*Owner{},
+		statuses:        map[string][]RideStatus{},
+		metrics:         map[string]*RideMetrics{},
+		stops:           map[string][]RideStop{},
+		couponDiscounts: map[string]int{},
+	}
+	if len(rides) == 0 {
+		return details, nil
+	}
+
+	rideIDs := make([]string, 0, len(rides))
+	chairIDs := []string{}
+	for _, ride := range rides {
+		rideIDs = append(rideIDs, ride.ID)
+		if ride.ChairID.Valid {
+			chairIDs = append(chairIDs, ride.ChairID.String)
+		}
+	}
+
+	if len(chairIDs) > 0 {
+		query, args, err := sqlx.In(`SELECT * FROM chairs WHERE id IN (?)`, chairIDs)
+		if err != nil {
+			return nil, err
+		}
+		chairs := []Chair{}
+		if err := ridesTx.SelectContext(ctx, &chairs, query, args...); err != nil {
+			return nil, err
+		}
+		for i := range chairs {
+			details.chairs[chairs[i].ID] = &chairs[i]
+			if _, ok := details.owners[chairs[i].OwnerID]; ok {
+				continue
+			}
+			owner, err := ownerByIDCache.Get(ctx, chairs[i].OwnerID)
+			if err != nil {
+				return nil, err
+			}
+			details.owners[chairs[i].OwnerID] = owner
+		}
+	}
+
+	query, args, err := sqlx.In(`SELECT * FROM ride_statuses WHERE ride_id IN (?) ORDER BY created_at`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []RideStatus{}
+	if err := ridesTx.SelectContext(ctx, &statuses, query, args...); err != nil {
+		return nil, err
+	}
+	for _, s := range statuses {
+		details.statuses[s.RideID] = append(details.statuses[s.RideID], s)
+	}
+
+	query, args, err = sqlx.In(`SELECT * FROM ride_metrics WHERE ride_id IN (?)`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	metrics := []RideMetrics{}
+	if err := ridesTx.SelectContext(ctx, &metrics, query, args...); err != nil {
+		return nil, err
+	}
+	for i := range metrics {
+		details.metrics[metrics[i].RideID] = &metrics[i]
+	}
+
+	query, args, err = sqlx.In(`SELECT * FROM ride_stops WHERE ride_id IN (?) ORDER BY ride_id, stop_index`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	stops := []RideStop{}
+	if err := ridesTx.SelectContext(ctx, &stops, query, args...); err != nil {
+		return nil, err
+	}
+	for _, s := range stops {
+		details.stops[s.RideID] = append(details.stops[s.RideID], s)
+	}
+
+	query, args, err = sqlx.In(`SELECT * FROM coupons WHERE used_by IN (?)`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, query, args...); err != nil {
+		return nil, err
+	}
+	for _, c := range coupons {
+		details.couponDiscounts[*c.UsedBy] = c.Discount
+	}
+
+	return details, nil
+}
+
+// 記録がまだ無いライドは全て0で返す
+func (d *rideHistoryDetails) rideMetrics(rideID string) *RideMetrics {
+	if m, ok := d.metrics[rideID]; ok {
+		return m
+	}
+	return &RideMetrics{RideID: rideID}
+}
+
+func (d *rideHistoryDetails) arrivedAt(rideID string) *int64 {
+	for _, s := range d.statuses[rideID] {
+		if s.Status == "ARRIVED" {
+			t := s.CreatedAt.UnixMilli()
+			return &t
+		}
+	}
+	return nil
+}
+
+func (d *rideHistoryDetails) chair(ride Ride) *getAppRidesResponseItemChair {
+	if !ride.ChairID.Valid {
+		return nil
+	}
+	chair, ok := d.chairs[ride.ChairID.String]
+	if !ok {
+		return nil
+	}
+	c := &getAppRidesResponseItemChair{
+		ID:    chair.ID,
+		Name:  chair.Name,
+		Model: chair.Model,
+	}
+	if owner, ok := d.owners[chair.OwnerID]; ok {
+		c.Owner = owner.Name
+	}
+	return c
+}
+
+type appGetRideResponse struct {
+	ID                    string                        `json:"id"`
+	PickupCoordinate      Coordinate                    `json:"pickup_coordinate"`
+	Stops                 []rideStopResponse            `json:"stops"`
+	DestinationCoordinate Coordinate                    `json:"destination_coordinate"`
+	Status                string                        `json:"status"`
+	Statuses              []appGetRideResponseStatus    `json:"statuses"`
+	Chair                 *getAppRidesResponseItemChair `json:"chair"`
+	Pooled                bool                          `json:"pooled"`
+	Tier                  *string                       `json:"tier"`
+	Fare                  fareBreakdown                 `json:"fare"`
+	PaymentState          string                        `json:"payment_state"`
+	Evaluation            *int                          `json:"evaluation"`
+	Metrics               appRideMetrics                `json:"metrics"`
+	Legs                  []rideLegResponse             `json:"legs"`
+	RequestedAt           int64                         `json:"requested_at"`
+}
+
+type appGetRideResponseStatus struct {
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func appGetRide(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	rideID := r.PathValue("ride_id")
+
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	ride := Ride{}
+	if err := ridesTx.GetContext(ctx, &ride, `SELECT * FROM rides WHERE id = ? AND user_id = ?`, rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	details, err := loadRideHistoryDetails(ctx, tx, ridesTx, []Ride{ride})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statuses := []appGetRideResponseStatus{}
+	for _, s := range details.statuses[ride.ID] {
+		statuses = append(statuses, appGetRideResponseStatus{Status: s.Status, CreatedAt: s.CreatedAt.UnixMilli()})
+	}
+	status := ""
+	if len(statuses) > 0 {
+		status = statuses[len(statuses)-1].Status
+	}
+	stops := details.stops[ride.ID]
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &appGetRideResponse{
+		ID:                    ride.ID,
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		Stops:                 newRideStopResponses(stops),
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Status:                status,
+		Statuses:              statuses,
+		Chair:                 details.chair(ride),
+		Pooled:                ride.Pooled,
+		Tier:                  ride.Tier,
+		Fare:                  newFareBreakdown(quoteForRide(ride), details.couponDiscounts[ride.ID]),
+		PaymentState:          paymentStateForStatus(status),
+		Evaluation:            ride.Evaluation,
+		Metrics:               newAppRideMetrics(details.rideMetrics(ride.ID)),
+		Legs:                  newRideLegResponses(ride, stops, details.arrivedAt(ride.ID)),
+		RequestedAt:           ride.CreatedAt.UnixMilli(),
+	})
+}
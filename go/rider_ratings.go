@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/motoki317/sc"
+)
+
+// 椅子が利用者の評価に付けられるタグ
+var riderRatingTags = map[string]bool{
+	"punctual": true,
+	"polite":   true,
+	"clean":    true,
+	"late":     true,
+	"rude":     true,
+	"messy":    true,
+	"no_show":  true,
+}
+
+// この件数以上評価されていて、平均がしきい値以下の利用者はマッチングを後回しにする
+var lowRiderRatingThreshold = func() float64 {
+	threshold := 2.0
+	if vStr, exists := os.LookupEnv("ISUCON_LOW_RIDER_RATING_THRESHOLD"); exists {
+		if val, err := strconv.ParseFloat(vStr, 64); err == nil {
+			threshold = val
+		}
+	}
+	return threshold
+}()
+
+var lowRiderRatingMinCount = func() int {
+	n := 3
+	if vStr, exists := os.LookupEnv("ISUCON_LOW_RIDER_RATING_MIN_COUNT"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val > 0 {
+			n = val
+		}
+	}
+	return n
+}()
+
+// 後回しにする期間の上限。これより長く待っているライドは評価にかかわらず古い順にマッチングする
+var lowRiderMaxDeferral = func() time.Duration {
+	seconds := 60
+	if vStr, exists := os.LookupEnv("ISUCON_LOW_RIDER_MAX_DEFERRAL_SECONDS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val >= 0 {
+			seconds = val
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}()
+
+type RiderRating struct {
+	RideID    string    `db:"ride_id"`
+	UserID    string    `db:"user_id"`
+	ChairID   string    `db:"chair_id"`
+	Rating    int       `db:"rating"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type riderScore struct {
+	Count   int     `db:"count"`
+	Average float64 `db:"average"`
+}
+
+var riderScoreCache, _ = sc.New(func(ctx context.Context, userID string) (*riderScore, error) {
+	score := &riderScore{}
+	if err := ridesDatabase().GetContext(ctx, score, "SELECT COUNT(*) AS count, IFNULL(AVG(rating), 0) AS average FROM rider_ratings WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	return score, nil
+}, 90*time.Second, 90*time.Second)
+
+// 評価が一時的に低いだけの利用者は後回しにしない
+func (s *riderScore) isLow() bool {
+	return s.Count >= lowRiderRatingMinCount && s.Average <= lowRiderRatingThreshold
+}
+
+// 評価が無ければ nil
+func (s *riderScore) rating() *float64 {
+	if s.Count == 0 {
+		return nil
+	}
+	average := s.Average
+	return &average
+}
+
+type chairPostRideRatingRequest struct {
+	Rating int      `json:"rating"`
+	Tags   []string `json:"tags"`
+}
+
+type chairPostRideRatingResponse struct {
+	Rating      float64 `json:"rating"`
+	RatingCount int     `json:"rating_count"`
+}
+
+func chairPostRideRating(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	chair := ctx.Value("chairOnlyNoChange").(*ChairOnlyNoChange)
+
+	req := &chairPostRideRatingRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		writeError(w, http.StatusBadRequest, errors.New("rating must be between 1 and 5"))
+		return
+	}
+	for _, tag := range req.Tags {
+		if !riderRatingTags[tag] {
+			writeError(w, http.StatusBadRequest, errors.New("invalid tag"))
+			return
+		}
+	}
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	ride := &Ride{}
+	if err := ridesTx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.ChairID.String != chair.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != "ARRIVED" && status != "COMPLETED" {
+		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+		return
+	}
+
+	var rated bool
+	if err := ridesTx.GetContext(ctx, &rated, "SELECT EXISTS (SELECT 1 FROM rider_ratings WHERE ride_id = ?)", ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if rated {
+		writeError(w, http.StatusConflict, errors.New("rider already rated"))
+		return
+	}
+
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		"INSERT INTO rider_ratings (ride_id, user_id, chair_id, rating) VALUES (?, ?, ?, ?)",
+		ride.ID, ride.UserID, chair.ID, req.Rating,
+	); err != nil {
+		if isDuplicateEntryError(err) {
+			writeError(w, http.StatusConflict, errors.New("rider already rated"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, tag := range req.Tags {
+		if _, err := ridesTx.ExecContext(ctx, "INSERT IGNORE INTO rider_rating_tags (ride_id, tag) VALUES (?, ?)", ride.ID, tag); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	riderScoreCache.Forget(ride.UserID)
+	score, err := riderScoreCache.Get(ctx, ride.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairPostRideRatingResponse{
+		Rating:      score.Average,
+		RatingCount: score.Count,
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	salesBucketHour  = "hour"
+	salesBucketDay   = "day"
+	salesBucketWeek  = "week"
+	salesBucketMonth = "month"
+)
+
+type ChairSalesHourly struct {
+	ChairID          string    `db:"chair_id"`
+	OwnerID          string    `db:"owner_id"`
+	Hour             time.Time `db:"hour"`
+	Sales            int       `db:"sales"`
+	RideCount        int       `db:"ride_count"`
+	EvaluationSum    int       `db:"evaluation_sum"`
+	PickupDistance   int       `db:"pickup_distance"`
+	CarryingDistance int       `db:"carrying_distance"`
+	WaitTimeMs       int64     `db:"wait_time_ms"`
+	PickupTimeMs     int64     `db:"pickup_time_ms"`
+	TripTimeMs       int64     `db:"trip_time_ms"`
+}
+
+// ライドが完了した時点の椅子の所有者。rides と chairs を JOIN したクエリの中で使う
+// 譲渡された椅子は chair_ownerships から引き、それ以外は今の所有者
+const rideSaleOwnerID = `COALESCE((SELECT chair_ownerships.owner_id FROM chair_ownerships
+	WHERE chair_ownerships.chair_id = rides.chair_id AND chair_ownerships.started_at <= rides.updated_at
+	ORDER BY chair_ownerships.started_at DESC LIMIT 1), chairs.owner_id)`
+
+// 椅子の譲渡を所有者の履歴に残す。最初の譲渡では譲渡元の所有期間も登録日時から記録する
+// 譲渡の前に完了したライドの売上は譲渡元のものとして残る
+func recordChairOwnershipTransfer(ctx context.Context, ridesTx *sqlx.Tx, chair *Chair, newOwnerID string) error {
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		"INSERT IGNORE INTO chair_ownerships (chair_id, owner_id, started_at) VALUES (?, ?, ?)",
+		chair.ID, chair.OwnerID, chair.CreatedAt,
+	); err != nil {
+		return err
+	}
+	_, err := ridesTx.ExecContext(
+		ctx,
+		"INSERT INTO chair_ownerships (chair_id, owner_id, started_at) VALUES (?, ?, CURRENT_TIMESTAMP(6))",
+		chair.ID, newOwnerID,
+	)
+	return err
+}
+
+// 完了したライドの売上と距離・所要時間を時間別・日別集計に加算する
+// 売上はその時点の椅子の所有者に計上し、後で譲渡しても移らない
+// ride は COMPLETED を記録した後に取得し直したもの(updated_at が完了日時になっている)を渡すこと
+func recordChairSale(ctx context.Context, ridesTx *sqlx.Tx, ride *Ride, metrics *RideMetrics) error {
+	if !ride.ChairID.Valid {
+		return errors.New("ride is not assigned to any chair")
+	}
+	var ownerID string
+	if err := ridesTx.GetContext(ctx, &ownerID, "SELECT owner_id FROM chairs WHERE id = ?", ride.ChairID.String); err != nil {
+		return err
+	}
+	evaluation := 0
+	if ride.Evaluation != nil {
+		evaluation = *ride.Evaluation
+	}
+	sale := calculateSale(*ride)
+
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_hourly (chair_id, owner_id, hour, sales, ride_count, evaluation_sum, pickup_distance, carrying_distance, wait_time_ms, pickup_time_ms, trip_time_ms)
+			VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+				sales = sales + VALUES(sales),
+				ride_count = ride_count + 1,
+				evaluation_sum = evaluation_sum + VALUES(evaluation_sum),
+				pickup_distance = pickup_distance + VALUES(pickup_distance),
+				carrying_distance = carrying_distance + VALUES(carrying_distance),
+				wait_time_ms = wait_time_ms + VALUES(wait_time_ms),
+				pickup_time_ms = pickup_time_ms + VALUES(pickup_time_ms),
+				trip_time_ms = trip_time_ms + VALUES(trip_time_ms)`,
+		ride.ChairID.String, ownerID, ride.UpdatedAt.Truncate(time.Hour), sale, evaluation,
+		metrics.PickupDistance, metrics.CarryingDistance, metrics.WaitTimeMs, metrics.PickupTimeMs, metrics.TripTimeMs,
+	); err != nil {
+		return err
+	}
+
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_daily (chair_id, owner_id, day, sales, ride_count, evaluation_sum, pickup_distance, carrying_distance, wait_time_ms, pickup_time_ms, trip_time_ms)
+			VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+				sales = sales + VALUES(sales),
+				ride_count = ride_count + 1,
+				evaluation_sum = evaluation_sum + VALUES(evaluation_sum),
+				pickup_distance = pickup_distance + VALUES(pickup_distance),
+				carrying_distance = carrying_distance + VALUES(carrying_distance),
+				wait_time_ms = wait_time_ms + VALUES(wait_time_ms),
+				pickup_time_ms = pickup_time_ms + VALUES(pickup_time_ms),
+				trip_time_ms = trip_time_ms + VALUES(trip_time_ms)`,
+		ride.ChairID.String, ownerID, truncateToSalesBucket(ride.UpdatedAt, salesBucketDay), sale, evaluation,
+		metrics.PickupDistance, metrics.CarryingDistance, metrics.WaitTimeMs, metrics.PickupTimeMs, metrics.TripTimeMs,
+	); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// rides / ride_statuses から売上集計(とその元になるライドごとの所要時間)を作り直す
+// 初期データ投入後(postInitialize)と rebuild-sales コマンドから呼ばれる
+func rebuildSalesAggregates(ctx context.Context) error {
+	tx, err := ridesDatabase().Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 集計の元になるライドごとの所要時間を先に作る
+	if err := rebuildRideMetrics(ctx, tx); err != nil {
+		return err
+	}
+
+	completedRides := `FROM rides
+		JOIN ride_statuses ON rides.id = ride_statuses.ride_id
+		JOIN chairs ON chairs.id = rides.chair_id
+		LEFT JOIN ride_metrics ON rides.id = ride_metrics.ride_id
+		WHERE ride_statuses.status = 'COMPLETED' AND rides.chair_id IS NOT NULL`
+	sums := `SUM(? + ? * IFNULL(rides.route_distance, ABS(rides.pickup_latitude - rides.destination_latitude) + ABS(rides.pickup_longitude - rides.destination_longitude)) * CASE rides.tier WHEN ? THEN ? WHEN ? THEN ? ELSE 100 END DIV 100 * (100 - IF(rides.pooled, ?, 0)) DIV 100),
+		COUNT(*),
+		SUM(IFNULL(rides.evaluation, 0)),
+		SUM(IFNULL(ride_metrics.pickup_distance, 0)),
+		SUM(IFNULL(ride_metrics.carrying_distance, 0)),
+		SUM(IFNULL(ride_metrics.wait_time_ms, 0)),
+		SUM(IFNULL(ride_metrics.pickup_time_ms, 0)),
+		SUM(IFNULL(ride_metrics.trip_time_ms, 0))`
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chair_sales_hourly`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_hourly (chair_id, owner_id, hour, sales, ride_count, evaluation_sum, pickup_distance, carrying_distance, wait_time_ms, pickup_time_ms, trip_time_ms)
+			SELECT rides.chair_id, `+rideSaleOwnerID+` AS sale_owner_id, DATE_FORMAT(rides.updated_at, '%Y-%m-%d %H:00:00') AS hour, `+sums+`
+			`+completedRides+`
+			GROUP BY rides.chair_id, sale_owner_id, hour`,
+		initialFare, farePerDistance,
+		chairTierComfort, chairTierFarePercent(chairTierComfort), chairTierPremium, chairTierFarePercent(chairTierPremium),
+		pooledDiscountPercent,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chair_sales_daily`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_daily (chair_id, owner_id, day, sales, ride_count, evaluation_sum, pickup_distance, carrying_distance, wait_time_ms, pickup_time_ms, trip_time_ms)
+			SELECT rides.chair_id, `+rideSaleOwnerID+` AS sale_owner_id, DATE(rides.updated_at) AS day, `+sums+`
+			`+completedRides+`
+			GROUP BY rides.chair_id, sale_owner_id, day`,
+		initialFare, farePerDistance,
+		chairTierComfort, chairTierFarePercent(chairTierComfort), chairTierPremium, chairTierFarePercent(chairTierPremium),
+		pooledDiscountPercent,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// オーナーの椅子ごとの [since, until) の売上を返す
+// 譲渡した椅子も、所有していた間の売上は含む
+// 丸一日分は日別集計から、端の半端な日は rides から直接集計する(最大2日分)
+func getOwnerChairSales(ctx context.Context, ownerID string, since, until time.Time) (map[string]int, error) {
+	salesByChair := map[string]int{}
+	if !since.Before(until) {
+		return salesByChair, nil
+	}
+
+	firstFullDay := truncateToSalesBucket(since, salesBucketDay)
+	if firstFullDay.Before(since) {
+		firstFullDay = firstFullDay.AddDate(0, 0, 1)
+	}
+	lastFullDayEnd := truncateToSalesBucket(until, salesBucketDay)
+
+	partials := [][2]time.Time{}
+	if firstFullDay.Before(lastFullDayEnd) {
+		type dailySales struct {
+			ChairID string `db:"chair_id"`
+			Sales   int    `db:"sales"`
+		}
+		rows := []dailySales{}
+		if err := ridesDatabase().SelectContext(
+			ctx,
+			&rows,
+			`SELECT chair_sales_daily.chair_id, SUM(chair_sales_daily.sales) AS sales
+				FROM chair_sales_daily
+				WHERE chair_sales_daily.owner_id = ? AND chair_sales_daily.day >= ? AND chair_sales_daily.day < ?
+				GROUP BY chair_sales_daily.chair_id`,
+			ownerID, firstFullDay, lastFullDayEnd,
+		); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			salesByChair[row.ChairID] += row.Sales
+		}
+
+		if since.Before(firstFullDay) {
+			partials = append(partials, [2]time.Time{since, firstFullDay})
+		}
+		if lastFullDayEnd.Before(until) {
+			partials = append(partials, [2]time.Time{lastFullDayEnd, until})
+		}
+	} else {
+		// 丸一日に満たない範囲
+		partials = append(partials, [2]time.Time{since, until})
+	}
+
+	for _, partial := range partials {
+		rides := []Ride{}
+		if err := ridesDatabase().SelectContext(
+			ctx,
+			&rides,
+			`SELECT rides.*
+				FROM rides
+				JOIN ride_statuses ON rides.id = ride_statuses.ride_id
+				JOIN chairs ON chairs.id = rides.chair_id
+				WHERE `+rideSaleOwnerID+` = ? AND ride_statuses.status = 'COMPLETED' AND rides.updated_at >= ? AND rides.updated_at < ?`,
+			ownerID, partial[0], partial[1],
+		); err != nil {
+			return nil, err
+		}
+		for _, ride := range rides {
+			salesByChair[ride.ChairID.String] += calculateSale(ride)
+		}
+	}
+
+	return salesByChair, nil
+}
+
+func isValidSalesBucket(bucket string) bool {
+	switch bucket {
+	case salesBucketHour, salesBucketDay, salesBucketWeek, salesBucketMonth:
+		return true
+	}
+	return false
+}
+
+// t が属するバケットの開始時刻を返す (週は月曜始まり)
+func truncateToSalesBucket(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	switch bucket {
+	case salesBucketHour:
+		return t.Truncate(time.Hour)
+	case salesBucketDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case salesBucketWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case salesBucketMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	chairActivityReasonManual   = "manual"
+	chairActivityReasonOwner    = "owner"
+	chairActivityReasonSchedule = "schedule"
+	chairActivityReasonDeferred = "deferred"
+	chairActivityReasonDeleted  = "deleted"
+)
+
+type ChairSchedule struct {
+	ID          string    `db:"id"`
+	ChairID     string    `db:"chair_id"`
+	DayOfWeek   int       `db:"day_of_week"`
+	StartMinute int       `db:"start_minute"`
+	EndMinute   int       `db:"end_minute"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type ChairActivityLog struct {
+	ID        string    `db:"id"`
+	ChairID   string    `db:"chair_id"`
+	IsActive  bool      `db:"is_active"`
+	Reason    string    `db:"reason"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// 画面に出す稼働状態。finishing は走行中のライドを終えたら停止する状態
+const (
+	chairStateActive    = "active"
+	chairStateFinishing = "finishing"
+	chairStateInactive  = "inactive"
+)
+
+func chairState(isActive, pendingDeactivation bool) string {
+	switch {
+	case !isActive:
+		return chairStateInactive
+	case pendingDeactivation:
+		return chairStateFinishing
+	default:
+		return chairStateActive
+	}
+}
+
+// 稼働状態を変更して履歴に残す。状態が変わらなければ何もしない
+func updateChairActive(ctx context.Context, ridesTx *sqlx.Tx, chairID string, active bool, reason string) error {
+	var current bool
+	if err := ridesTx.GetContext(ctx, &current, "SELECT is_active FROM chairs WHERE id = ? FOR UPDATE", chairID); err != nil {
+		return err
+	}
+	if _, err := ridesTx.ExecContext(ctx, "UPDATE chairs SET is_active = ?, pending_deactivation = FALSE WHERE id = ?", active, chairID); err != nil {
+		return err
+	}
+	if current == active {
+		return nil
+	}
+	_, err := ridesTx.ExecContext(
+		ctx,
+		"INSERT INTO chair_activity_logs (id, chair_id, is_active, reason) VALUES (?, ?, ?, ?)",
+		ulid.Make().String(), chairID, active, reason,
+	)
+	return err
+}
+
+// 稼働を止めるときに走行中のライドがあれば、完了するまで停止を保留する
+// 保留した場合は true を返す
+func setChairActive(ctx context.Context, ridesTx *sqlx.Tx, chairID string, active bool, reason string) (bool, error) {
+	if !active {
+		hasActiveRide, err := hasChairActiveRide(ctx, ridesTx, chairID)
+		if err != nil {
+			return false, err
+		}
+		if hasActiveRide {
+			_, err := ridesTx.ExecContext(ctx, "UPDATE chairs SET pending_deactivation = TRUE WHERE id = ?", chairID)
+			return true, err
+		}
+	}
+	return false, updateChairActive(ctx, ridesTx, chairID, active, reason)
+}
+
+// ライドの完了時に保留していた停止を反映する
+func applyPendingChairDeactivation(ctx context.Context, ridesTx *sqlx.Tx, chairID string) error {
+	var pending bool
+	if err := ridesTx.GetContext(ctx, &pending, "SELECT pending_deactivation FROM chairs WHERE id = ?", chairID); err != nil {
+		return err
+	}
+	if !pending {
+		return nil
+	}
+	return updateChairActive(ctx, ridesTx, chairID, false, chairActivityReasonDeferred)
+}
+
+// 時刻は UTC で扱う
+func isInChairSchedule(schedules []ChairSchedule, t time.Time) bool {
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	for _, s := range schedules {
+		if s.DayOfWeek == int(t.Weekday()) && s.StartMinute <= minute && minute < s.EndMinute {
+			return true
+		}
+	}
+	return false
+}
+
+// 前回の実行から今回までにシフトの境界をまたいだ椅子だけ稼働状態を切り替える
+// 境界以外では手動の切り替えを上書きしない
+func applyChairSchedules(ctx context.Context, from, to time.Time) error {
+	schedules := []ChairSchedule{}
+	if err := ridesDatabase().SelectContext(
+		ctx,
+		&schedules,
+		`SELECT chair_schedules.* FROM chair_schedules
+			JOIN chairs ON chairs.id = chair_schedules.chair_id
+			WHERE chairs.deleted_at IS NULL`,
+	); err != nil {
+		return err
+	}
+	schedulesByChair := map[string][]ChairSchedule{}
+	for _, s := range schedules {
+		schedulesByChair[s.ChairID] = append(schedulesByChair[s.ChairID], s)
+	}
+
+	for chairID, chairSchedules := range schedulesByChair {
+		wasOn, isOn := isInChairSchedule(chairSchedules, from), isInChairSchedule(chairSchedules, to)
+		if wasOn == isOn {
+			continue
+		}
+		if err := applyChairSchedule(ctx, chairID, isOn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyChairSchedule(ctx context.Context, chairID string, active bool) error {
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		return err
+	}
+	defer ridesTx.Rollback()
+
+	if _, err := setChairActive(ctx, ridesTx, chairID, active, chairActivityReasonSchedule); err != nil {
+		return err
+	}
+	return ridesTx.Commit()
+}
+
+func startChairScheduler() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for now := range ticker.C {
+		if err := applyChairSchedules(context.Background(), last, now); err != nil {
+			slog.Error("Failed to apply chair schedules", "err", err)
+			continue
+		}
+		last = now
+	}
+}
+
+type chairScheduleSlot struct {
+	DayOfWeek int    `json:"day_of_week"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+type ownerChairScheduleRequest struct {
+	Slots []chairScheduleSlot `json:"slots"`
+}
+
+type ownerChairScheduleResponse struct {
+	ChairID string              `json:"chair_id"`
+	Slots   []chairScheduleSlot `json:"slots"`
+}
+
+// "HH:MM" を0時からの分に変換する。終了時刻として "24:00" を許す
+func parseScheduleTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatScheduleTime(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
+
+func getOwnerChairSchedule(ctx context.Context, ownerID, chairID string) (*ownerChairScheduleResponse, error) {
+	chair := &Chair{}
+	if err := ridesDatabase().GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? AND deleted_at IS NULL", chairID, ownerID); err != nil {
+		return nil, err
+	}
+	schedules := []ChairSchedule{}
+	if err := ridesDatabase().SelectContext(ctx, &schedules, "SELECT * FROM chair_schedules WHERE chair_id = ? ORDER BY day_of_week, start_minute", chairID); err != nil {
+		return nil, err
+	}
+	res := &ownerChairScheduleResponse{ChairID: chairID, Slots: []chairScheduleSlot{}}
+	for _, s := range schedules {
+		res.Slots = append(res.Slots, chairScheduleSlot{
+			DayOfWeek: s.DayOfWeek,
+			StartTime: formatScheduleTime(s.StartMinute),
+			EndTime:   formatScheduleTime(s.EndMinute),
+		})
+	}
+	return res, nil
+}
+
+func ownerGetChairSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	res, err := getOwnerChairSchedule(ctx, owner.ID, r.PathValue("chair_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 週ごとの稼働予定を置き換える。曜日は日曜を0とし、時刻は UTC で指定する
+// 日をまたぐシフトは2つの枠に分けて指定する
+func ownerPutChairSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerChairScheduleRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	schedules := make([]ChairSchedule, 0, len(req.Slots))
+	for _, slot := range req.Slots {
+		if slot.DayOfWeek < 0 || slot.DayOfWeek > 6 {
+			writeError(w, http.StatusBadRequest, errors.New("day_of_week must be between 0 and 6"))
+			return
+		}
+		start, err := parseScheduleTime(slot.StartTime)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		end, err := parseScheduleTime(slot.EndTime)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if start >= end {
+			writeError(w, http.StatusBadRequest, errors.New("end_time must be after start_time"))
+			return
+		}
+		for _, s := range schedules {
+			if s.DayOfWeek == slot.DayOfWeek && start < s.EndMinute && s.StartMinute < end {
+				writeError(w, http.StatusBadRequest, errors.New("slots must not overlap"))
+				return
+			}
+		}
+		schedules = append(schedules, ChairSchedule{
+			ID:          ulid.Make().String(),
+			ChairID:     chairID,
+			DayOfWeek:   slot.DayOfWeek,
+			StartMinute: start,
+			EndMinute:   end,
+		})
+	}
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer ridesTx.Rollback()
+
+	if _, err := getOwnedChairForUpdate(ctx, ridesTx, owner.ID, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := ridesTx.ExecContext(ctx, "DELETE FROM chair_schedules WHERE chair_id = ?", chairID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(schedules) > 0 {
+		if _, err := ridesTx.NamedExecContext(
+			ctx,
+			`INSERT INTO chair_schedules (id, chair_id, day_of_week, start_minute, end_minute)
+				VALUES (:id, :chair_id, :day_of_week, :start_minute, :end_minute)`,
+			schedules,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := ridesTx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, err := getOwnerChairSchedule(ctx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 週ごとの予定を [since, until) の期間に展開して合計時間を求める
+func scheduledDuration(schedules []ChairSchedule, since, until time.Time) time.Duration {
+	total := time.Duration(0)
+	since, until = since.UTC(), until.UTC()
+	for day := since.Truncate(24 * time.Hour); day.Before(until); day = day.Add(24 * time.Hour) {
+		for _, s := range schedules {
+			if s.DayOfWeek != int(day.Weekday()) {
+				continue
+			}
+			start := day.Add(time.Duration(s.StartMinute) * time.Minute)
+			end := day.Add(time.Duration(s.EndMinute) * time.Minute)
+			if start.Before(since) {
+				start = since
+			}
+			if end.After(until) {
+				end = until
+			}
+			if end.After(start) {
+				total += end.Sub(start)
+			}
+		}
+	}
+	return total
+}
+
+// 稼働履歴から [since, until) の間に稼働していた時間を求める
+// 期間開始時点の状態は直前の履歴から、履歴が無ければ期間中の最初の履歴の逆とみなす
+func onlineDuration(ctx context.Context, chair *Chair, since, until time.Time) (time.Duration, error) {
+	if since.Before(chair.CreatedAt) {
+		since = chair.CreatedAt
+	}
+	if !until.After(since) {
+		return 0, nil
+	}
+
+	logs := []ChairActivityLog{}
+	if err := ridesDatabase().SelectContext(
+		ctx,
+		&logs,
+		`SELECT * FROM chair_activity_logs WHERE chair_id = ? AND created_at >= ? AND created_at < ? ORDER BY created_at, id`,
+		chair.ID, since, until,
+	); err != nil {
+		return 0, err
+	}
+
+	active := chair.IsActive
+	before := &ChairActivityLog{}
+	if err := ridesDatabase().GetContext(
+		ctx,
+		before,
+		`SELECT * FROM chair_activity_logs WHERE chair_id = ? AND created_at < ? ORDER BY created_at DESC, id DESC LIMIT 1`,
+		chair.ID, since,
+	); err == nil {
+		active = before.IsActive
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	} else if len(logs) > 0 {
+		active = !logs[0].IsActive
+	}
+
+	total := time.Duration(0)
+	at := since
+	for _, l := range logs {
+		if active {
+			total += l.CreatedAt.Sub(at)
+		}
+		active = l.IsActive
+		at = l.CreatedAt
+	}
+	if active {
+		total += until.Sub(at)
+	}
+	return total, nil
+}
+
+type ownerGetChairAvailabilityResponse struct {
+	Since  int64                                    `json:"since"`
+	Until  int64                                    `json:"until"`
+	Chairs []ownerGetChairAvailabilityResponseChair `json:"chairs"`
+}
+
+type ownerGetChairAvailabilityResponseChair struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ScheduledMs int64  `json:"scheduled_ms"`
+	OnlineMs    int64  `json:"online_ms"`
+}
+
+// 椅子ごとの予定稼働時間と実際の稼働時間を返す。期間の既定は直近7日間
+func ownerGetChairAvailability(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	until := time.Now()
+	since := until.Add(-7 * 24 * time.Hour)
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		parsed, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if untilStr := r.URL.Query().Get("until"); untilStr != "" {
+		parsed, err := strconv.ParseInt(untilStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = time.UnixMilli(parsed)
+	}
+	if now := time.Now(); until.After(now) {
+		until = now
+	}
+	if !until.After(since) {
+		writeError(w, http.StatusBadRequest, errors.New("until must be after since"))
+		return
+	}
+
+	chairs := []Chair{}
+	if err := ridesDatabase().SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ? AND deleted_at IS NULL ORDER BY created_at", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairAvailabilityResponse{
+		Since:  since.UnixMilli(),
+		Until:  until.UnixMilli(),
+		Chairs: []ownerGetChairAvailabilityResponseChair{},
+	}
+	for _, chair := range chairs {
+		schedules := []ChairSchedule{}
+		if err := ridesDatabase().SelectContext(ctx, &schedules, "SELECT * FROM chair_schedules WHERE chair_id = ?", chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		online, err := onlineDuration(ctx, &chair, since, until)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		res.Chairs = append(res.Chairs, ownerGetChairAvailabilityResponseChair{
+			ID:          chair.ID,
+			Name:        chair.Name,
+			ScheduledMs: scheduledDuration(schedules, since, until).Milliseconds(),
+			OnlineMs:    online.Milliseconds(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/motoki317/sc"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	serviceAreaKindService   = "service"
+	serviceAreaKindExclusion = "exclusion"
+)
+
+type ServiceArea struct {
+	ID        string    `db:"id"`
+	Name      string    `db:"name"`
+	Kind      string    `db:"kind"`
+	Vertices  string    `db:"vertices"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type ChairServiceArea struct {
+	ChairID   string    `db:"chair_id"`
+	AreaID    string    `db:"area_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// 判定用に頂点を展開したエリア
+type serviceArea struct {
+	ServiceArea
+	vertices []Coordinate
+}
+
+func (a *serviceArea) contains(c Coordinate) bool {
+	return polygonContains(a.vertices, c)
+}
+
+// 多角形の内部または辺上にあるか
+func polygonContains(vertices []Coordinate, c Coordinate) bool {
+	inside := false
+	for i, j := 0, len(vertices)-1; i < len(vertices); j, i = i, i+1 {
+		a, b := vertices[j], vertices[i]
+		if isOnSegment(a, b, c) {
+			return true
+		}
+		if (a.Longitude > c.Longitude) != (b.Longitude > c.Longitude) {
+			// c を通る水平線と辺の交点が c より右にあるか
+			lhs := (c.Latitude - a.Latitude) * (b.Longitude - a.Longitude)
+			rhs := (b.Latitude - a.Latitude) * (c.Longitude - a.Longitude)
+			if (b.Longitude-a.Longitude > 0) == (lhs < rhs) {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func isOnSegment(a, b, c Coordinate) bool {
+	cross := (b.Latitude-a.Latitude)*(c.Longitude-a.Longitude) - (b.Longitude-a.Longitude)*(c.Latitude-a.Latitude)
+	if cross != 0 {
+		return false
+	}
+	return min(a.Latitude, b.Latitude) <= c.Latitude && c.Latitude <= max(a.Latitude, b.Latitude) &&
+		min(a.Longitude, b.Longitude) <= c.Longitude && c.Longitude <= max(a.Longitude, b.Longitude)
+}
+
+// エリアは運営しか変更しないので全件をまとめてキャッシュする
+var serviceAreasCache, _ = sc.New(func(ctx context.Context, _ struct{}) (map[string]*serviceArea, error) {
+	areas := []ServiceArea{}
+	if err := ridesDatabase().SelectContext(ctx, &areas, "SELECT * FROM service_areas"); err != nil {
+		return nil, err
+	}
+	res := make(map[string]*serviceArea, len(areas))
+	for _, a := range areas {
+		vertices := []Coordinate{}
+		if err := json.Unmarshal([]byte(a.Vertices), &vertices); err != nil {
+			return nil, err
+		}
+		res[a.ID] = &serviceArea{ServiceArea: a, vertices: vertices}
+	}
+	return res, nil
+}, 5*time.Minute, 5*time.Minute)
+
+var chairServiceAreasCache, _ = sc.New(func(ctx context.Context, chairID string) ([]string, error) {
+	areaIDs := []string{}
+	err := ridesDatabase().SelectContext(ctx, &areaIDs, "SELECT area_id FROM chair_service_areas WHERE chair_id = ?", chairID)
+	return areaIDs, err
+}, 90*time.Second, 90*time.Second)
+
+// サービスエリアが1つも無ければどこでも営業しているものとみなす
+// いずれかのサービスエリアに含まれ、どの営業対象外エリアにも含まれなければ営業範囲内
+func isInService(ctx context.Context, c Coordinate) (bool, error) {
+	areas, err := serviceAreasCache.Get(ctx, struct{}{})
+	if err != nil {
+		return false, err
+	}
+	hasServiceArea, inServiceArea := false, false
+	for _, a := range areas {
+		switch a.Kind {
+		case serviceAreaKindExclusion:
+			if a.contains(c) {
+				return false, nil
+			}
+		case serviceAreaKindService:
+			hasServiceArea = true
+			if a.contains(c) {
+				inServiceArea = true
+			}
+		}
+	}
+	return !hasServiceArea || inServiceArea, nil
+}
+
+var errOutOfServiceArea = errors.New("pickup or destination is out of service area")
+
+// 配車位置・目的地・経由地がすべて営業範囲内か
+func validateRideCoordinates(ctx context.Context, coordinates ...Coordinate) error {
+	for _, c := range coordinates {
+		ok, err := isInService(ctx, c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errOutOfServiceArea
+		}
+	}
+	return nil
+}
+
+// 椅子が登録したエリアの中で完結するライドかどうか
+// エリアを登録していない椅子はどのライドも担当できる
+func canChairServeRide(ctx context.Context, chairID string, ride *Ride) (bool, error) {
+	areaIDs, err := chairServiceAreasCache.Get(ctx, chairID)
+	if err != nil {
+		return false, err
+	}
+	if len(areaIDs) == 0 {
+		return true, nil
+	}
+	areas, err := serviceAreasCache.Get(ctx, struct{}{})
+	if err != nil {
+		return false, err
+	}
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	pickupOK, destinationOK := false, false
+	for _, id := range areaIDs {
+		a, ok := areas[id]
+		if !ok {
+			continue
+		}
+		pickupOK = pickupOK || a.contains(pickup)
+		destinationOK = destinationOK || a.contains(destination)
+	}
+	return pickupOK && destinationOK, nil
+}
+
+type serviceAreaRequest struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// 長方形の場合は対角の2点、多角形の場合は頂点を順に指定する
+	Rectangle *struct {
+		Min Coordinate `json:"min"`
+		Max Coordinate `json:"max"`
+	} `json:"rectangle"`
+	Polygon []Coordinate `json:"polygon"`
+}
+
+type serviceAreaResponse struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Kind      string       `json:"kind"`
+	Polygon   []Coordinate `json:"polygon"`
+	CreatedAt int64        `json:"created_at"`
+}
+
+func newServiceAreaResponse(a *serviceArea) serviceAreaResponse {
+	return serviceAreaResponse{
+		ID:        a.ID,
+		Name:      a.Name,
+		Kind:      a.Kind,
+		Polygon:   a.vertices,
+		CreatedAt: a.CreatedAt.UnixMilli(),
+	}
+}
+
+func operatorGetServiceAreas(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	areas, err := serviceAreasCache.Get(ctx, struct{}{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := []serviceAreaResponse{}
+	for _, a := range areas {
+		res = append(res, newServiceAreaResponse(a))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"service_areas": res})
+}
+
+func operatorPostServiceArea(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &serviceAreaRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = serviceAreaKindService
+	}
+	if req.Kind != serviceAreaKindService && req.Kind != serviceAreaKindExclusion {
+		writeError(w, http.StatusBadRequest, errors.New("kind must be service or exclusion"))
+		return
+	}
+
+	var vertices []Coordinate
+	switch {
+	case req.Rectangle != nil && req.Polygon == nil:
+		minC, maxC := req.Rectangle.Min, req.Rectangle.Max
+		if minC.Latitude >= maxC.Latitude || minC.Longitude >= maxC.Longitude {
+			writeError(w, http.StatusBadRequest, errors.New("rectangle max must be greater than min"))
+			return
+		}
+		vertices = []Coordinate{
+			{Latitude: minC.Latitude, Longitude: minC.Longitude},
+			{Latitude: maxC.Latitude, Longitude: minC.Longitude},
+			{Latitude: maxC.Latitude, Longitude: maxC.Longitude},
+			{Latitude: minC.Latitude, Longitude: maxC.Longitude},
+		}
+	case req.Polygon != nil && req.Rectangle == nil:
+		if len(req.Polygon) < 3 {
+			writeError(w, http.StatusBadRequest, errors.New("polygon requires at least 3 vertices"))
+			return
+		}
+		vertices = req.Polygon
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("either rectangle or polygon is required"))
+		return
+	}
+
+	encoded, err := json.Marshal(vertices)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	area := &serviceArea{
+		ServiceArea: ServiceArea{
+			ID:       ulid.Make().String(),
+			Name:     req.Name,
+			Kind:     req.Kind,
+			Vertices: string(encoded),
+		},
+		vertices: vertices,
+	}
+	if _, err := ridesDatabase().ExecContext(ctx, "INSERT INTO service_areas (id, name, kind, vertices) VALUES (?, ?, ?, ?)", area.ID, area.Name, area.Kind, area.Vertices); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := ridesDatabase().GetContext(ctx, &area.ServiceArea, "SELECT * FROM service_areas WHERE id = ?", area.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	serviceAreasCache.Purge()
+
+	writeJSON(w, http.StatusCreated, newServiceAreaResponse(area))
+}
+
+func operatorDeleteServiceArea(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	areaID := r.PathValue("area_id")
+
+	tx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM service_areas WHERE id = ?", areaID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("service area not found"))
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_service_areas WHERE area_id = ?", areaID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	serviceAreasCache.Purge()
+	chairServiceAreasCache.Purge()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerChairServiceAreasRequest struct {
+	AreaIDs []string `json:"area_ids"`
+}
+
+type ownerChairServiceAreasResponse struct {
+	ChairID      string                `json:"chair_id"`
+	ServiceAreas []serviceAreaResponse `json:"service_areas"`
+}
+
+func getOwnerChairServiceAreas(ctx context.Context, ownerID, chairID string) (*ownerChairServiceAreasResponse, error) {
+	chair := &Chair{}
+	if err := ridesDatabase().GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? AND deleted_at IS NULL", chairID, ownerID); err != nil {
+		return nil, err
+	}
+	areaIDs := []string{}
+	if err := ridesDatabase().SelectContext(ctx, &areaIDs, "SELECT area_id FROM chair_service_areas WHERE chair_id = ? ORDER BY area_id", chairID); err != nil {
+		return nil, err
+	}
+	areas, err := serviceAreasCache.Get(ctx, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	res := &ownerChairServiceAreasResponse{ChairID: chairID, ServiceAreas: []serviceAreaResponse{}}
+	for _, id := range areaIDs {
+		if a, ok := areas[id]; ok {
+			res.ServiceAreas = append(res.ServiceAreas, newServiceAreaResponse(a))
+		}
+	}
+	return res, nil
+}
+
+func ownerGetChairServiceAreas(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	res, err := getOwnerChairServiceAreas(ctx, owner.ID, r.PathValue("chair_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 椅子が営業するエリアを置き換える。空にすると制限なしに戻る
+func ownerPutChairServiceAreas(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerChairServiceAreasRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	areas, err := serviceAreasCache.Get(ctx, struct{}{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, id := range req.AreaIDs {
+		a, ok := areas[id]
+		if !ok {
+			writeError(w, http.StatusBadRequest, errors.New("service area not found"))
+			return
+		}
+		if a.Kind != serviceAreaKindService {
+			writeError(w, http.StatusBadRequest, errors.New("chairs can only be assigned to service areas"))
+			return
+		}
+	}
+
+	tx, err := ridesDatabase().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := getOwnedChairForUpdate(ctx, tx, owner.ID, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_service_areas WHERE chair_id = ?", chairID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(req.AreaIDs) > 0 {
+		rows := make([]ChairServiceArea, 0, len(req.AreaIDs))
+		seen := map[string]bool{}
+		for _, id := range req.AreaIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			rows = append(rows, ChairServiceArea{ChairID: chairID, AreaID: id})
+		}
+		if _, err := sqlx.NamedExecContext(ctx, tx, "INSERT INTO chair_service_areas (chair_id, area_id) VALUES (:chair_id, :area_id)", rows); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairServiceAreasCache.Forget(chairID)
+
+	res, err := getOwnerChairServiceAreas(ctx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	sessionKindApp   = "app"
+	sessionKindOwner = "owner"
+	sessionKindChair = "chair"
+)
+
+var sessionCookieNames = map[string]string{
+	sessionKindApp:   "app_session",
+	sessionKindOwner: "owner_session",
+	sessionKindChair: "chair_session",
+}
+
+// 利用者とオーナーのセッションの有効期間
+// 椅子はログインし直す手段が無いので期限を設けず、オーナーが再発行したときに失効させる
+var sessionTTL = func() time.Duration {
+	hours := 24 * 30
+	if vStr, exists := os.LookupEnv("ISUCON_SESSION_TTL_HOURS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val > 0 {
+			hours = val
+		}
+	}
+	return time.Duration(hours) * time.Hour
+}()
+
+type Session struct {
+	ID        string       `db:"id"`
+	TokenHash string       `db:"token_hash"`
+	Kind      string       `db:"kind"`
+	SubjectID string       `db:"subject_id"`
+	UserAgent string       `db:"user_agent"`
+	CreatedAt time.Time    `db:"created_at"`
+	ExpiresAt sql.NullTime `db:"expires_at"`
+	RevokedAt sql.NullTime `db:"revoked_at"`
+}
+
+func (s *Session) isExpired(now time.Time) bool {
+	return s.ExpiresAt.Valid && !now.Before(s.ExpiresAt.Time)
+}
+
+// トークンは平文で保存しない
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 失効したセッションは行が残っていても引けないようにする
+// 失効をどのインスタンスにもすぐ反映させるため、キャッシュせずに毎回 token_hash の一意インデックスで引く
+func getSessionByTokenHash(ctx context.Context, tokenHash string) (*Session, error) {
+	session := &Session{}
+	if err := database().GetContext(ctx, session, "SELECT * FROM sessions WHERE token_hash = ? AND revoked_at IS NULL", tokenHash); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// 新しいセッションを発行して、cookie に入れるトークンを返す
+func createSession(ctx context.Context, db sqlx.ExecerContext, r *http.Request, kind, subjectID string) (string, error) {
+	token := secureRandomStr(32)
+	var expiresAt sql.NullTime
+	if kind != sessionKindChair {
+		expiresAt = sql.NullTime{Time: time.Now().Add(sessionTTL), Valid: true}
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		"INSERT INTO sessions (id, token_hash, kind, subject_id, user_agent, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		ulid.Make().String(), hashSessionToken(token), kind, subjectID, userAgent, expiresAt,
+	); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func setSessionCookie(w http.ResponseWriter, kind, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Path:  "/",
+		Name:  sessionCookieNames[kind],
+		Value: token,
+	})
+}
+
+var errInvalidSession = errors.New("invalid access token")
+
+type sessionCookieRequiredError struct {
+	name string
+}
+
+func (e *sessionCookieRequiredError) Error() string {
+	return e.name + " cookie is required"
+}
+
+// cookie のトークンに対応する有効なセッションを返す
+func authenticateSession(ctx context.Context, r *http.Request, kind string) (*Session, error) {
+	c, err := r.Cookie(sessionCookieNames[kind])
+	if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
+		return nil, &sessionCookieRequiredError{name: sessionCookieNames[kind]}
+	}
+	session, err := getSessionByTokenHash(ctx, hashSessionToken(c.Value))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errInvalidSession
+		}
+		return nil, err
+	}
+	if session.Kind != kind || session.isExpired(time.Now()) {
+		return nil, errInvalidSession
+	}
+	return session, nil
+}
+
+func revokeSession(ctx context.Context, session *Session) error {
+	_, err := database().ExecContext(ctx, "UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND revoked_at IS NULL", session.ID)
+	return err
+}
+
+// 退会やトークンの再発行のときに、その利用者・オーナー・椅子のセッションをすべて失効させる
+func revokeSubjectSessions(ctx context.Context, kind, subjectID string) error {
+	return revokeSubjectSessionsExcept(ctx, kind, subjectID, "")
+}
+
+// パスワードの変更やトークンの再発行のときに、今のセッション以外を失効させる
+func revokeOtherSessions(ctx context.Context, current *Session) error {
+	return revokeSubjectSessionsExcept(ctx, current.Kind, current.SubjectID, current.ID)
+}
+
+func revokeSubjectSessionsExcept(ctx context.Context, kind, subjectID, exceptID string) error {
+	sessions := []Session{}
+	if err := database().SelectContext(ctx, &sessions, "SELECT * FROM sessions WHERE kind = ? AND subject_id = ? AND id != ? AND revoked_at IS NULL", kind, subjectID, exceptID); err != nil {
+		return err
+	}
+	for i := range sessions {
+		if err := revokeSession(ctx, &sessions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 初期データのアクセストークンをセッションに移し、各テーブルにはハッシュだけを残す
+// 初期データ投入後(postInitialize)に一度だけ呼ばれる
+func migrateLegacySessions(ctx context.Context) error {
+	type legacyToken struct {
+		ID          string `db:"id"`
+		AccessToken string `db:"access_token"`
+	}
+	for _, t := range []struct {
+		kind  string
+		table string
+		db    *sqlx.DB
+	}{
+		{sessionKindApp, "users", database()},
+		{sessionKindOwner, "owners", database()},
+		{sessionKindChair, "chairs", ridesDatabase()},
+	} {
+		tokens := []legacyToken{}
+		if err := t.db.SelectContext(ctx, &tokens, "SELECT id, access_token FROM "+t.table); err != nil {
+			return err
+		}
+		var expiresAt sql.NullTime
+		if t.kind != sessionKindChair {
+			expiresAt = sql.NullTime{Time: time.Now().Add(sessionTTL), Valid: true}
+		}
+		sessions := make([]Session, 0, len(tokens))
+		for _, token := range tokens {
+			sessions = append(sessions, Session{
+				ID:        ulid.Make().String(),
+				TokenHash: hashSessionToken(token.AccessToken),
+				Kind:      t.kind,
+				SubjectID: token.ID,
+				ExpiresAt: expiresAt,
+			})
+		}
+		for start := 0; start < len(sessions); start += 1000 {
+			end := min(start+1000, len(sessions))
+			if _, err := database().NamedExecContext(
+				ctx,
+				"INSERT INTO sessions (id, token_hash, kind, subject_id, expires_at) VALUES (:id, :token_hash, :kind, :subject_id, :expires_at)",
+				sessions[start:end],
+			); err != nil {
+				return err
+			}
+		}
+		if _, err := t.db.ExecContext(ctx, "UPDATE "+t.table+" SET access_token = SHA2(access_token, 256)"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sessionResponse struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt *int64 `json:"expires_at"`
+	Current   bool   `json:"current"`
+}
+
+type getSessionsResponse struct {
+	Sessions []sessionResponse `json:"sessions"`
+}
+
+// 有効なセッションを新しい順に返す
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current := ctx.Value("session").(*Session)
+
+	sessions := []Session{}
+	if err := database().SelectContext(
+		ctx,
+		&sessions,
+		"SELECT * FROM sessions WHERE kind = ? AND subject_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) ORDER BY created_at DESC",
+		current.Kind, current.SubjectID, time.Now(),
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &getSessionsResponse{Sessions: []sessionResponse{}}
+	for _, s := range sessions {
+		item := sessionResponse{
+			ID:        s.ID,
+			UserAgent: s.UserAgent,
+			CreatedAt: s.CreatedAt.UnixMilli(),
+			Current:   s.ID == current.ID,
+		}
+		if s.ExpiresAt.Valid {
+			t := s.ExpiresAt.Time.UnixMilli()
+			item.ExpiresAt = &t
+		}
+		res.Sessions = append(res.Sessions, item)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current := ctx.Value("session").(*Session)
+	sessionID := r.PathValue("session_id")
+
+	session := &Session{}
+	if err := database().GetContext(
+		ctx,
+		session,
+		"SELECT * FROM sessions WHERE id = ? AND kind = ? AND subject_id = ? AND revoked_at IS NULL",
+		sessionID, current.Kind, current.SubjectID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("session not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := revokeSession(ctx, session); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 今のセッションを失効させて cookie も消す
+func postLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current := ctx.Value("session").(*Session)
+
+	if err := revokeSession(ctx, current); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Path:   "/",
+		Name:   sessionCookieNames[current.Kind],
+		MaxAge: -1,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
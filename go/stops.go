@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 経由地はライドあたりこの数まで指定できる
+var maxRideStops = func() int {
+	n := 3
+	if vStr, exists := os.LookupEnv("ISUCON_MAX_RIDE_STOPS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val >= 0 {
+			n = val
+		}
+	}
+	return n
+}()
+
+type RideStop struct {
+	RideID    string       `db:"ride_id"`
+	StopIndex int          `db:"stop_index"`
+	Latitude  int          `db:"latitude"`
+	Longitude int          `db:"longitude"`
+	ArrivedAt sql.NullTime `db:"arrived_at"`
+}
+
+func validateRideStops(stops []Coordinate) error {
+	if len(stops) > maxRideStops {
+		return fmt.Errorf("too many stops (max %d)", maxRideStops)
+	}
+	return nil
+}
+
+// 配車位置から経由地を順に回って目的地に着くまでの距離
+func calculateRouteDistance(pickup Coordinate, stops []Coordinate, destination Coordinate) int {
+	distance := 0
+	from := pickup
+	for _, to := range append(append([]Coordinate{}, stops...), destination) {
+		distance += calculateDistance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+		from = to
+	}
+	return distance
+}
+
+// 料金の対象になる距離。経由地の無いライドは route_distance を持たない
+func rideDistance(ride Ride) int {
+	if ride.RouteDistance != nil {
+		return *ride.RouteDistance
+	}
+	return calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+}
+
+func insertRideStops(ctx context.Context, ridesTx *sqlx.Tx, rideID string, stops []Coordinate) error {
+	if len(stops) == 0 {
+		return nil
+	}
+	rows := make([]RideStop, 0, len(stops))
+	for i, s := range stops {
+		rows = append(rows, RideStop{RideID: rideID, StopIndex: i + 1, Latitude: s.Latitude, Longitude: s.Longitude})
+	}
+	_, err := ridesTx.NamedExecContext(
+		ctx,
+		`INSERT INTO ride_stops (ride_id, stop_index, latitude, longitude) VALUES (:ride_id, :stop_index, :latitude, :longitude)`,
+		rows,
+	)
+	return err
+}
+
+func getRideStops(ctx context.Context, q sqlx.QueryerContext, rideID string) ([]RideStop, error) {
+	stops := []RideStop{}
+	if err := sqlx.SelectContext(ctx, q, &stops, `SELECT * FROM ride_stops WHERE ride_id = ? ORDER BY stop_index`, rideID); err != nil {
+		return nil, err
+	}
+	return stops, nil
+}
+
+func markRideStopArrived(ctx context.Context, ridesTx *sqlx.Tx, stop *RideStop, arrivedAt time.Time) error {
+	if _, err := ridesTx.ExecContext(
+		ctx,
+		`UPDATE ride_stops SET arrived_at = ? WHERE ride_id = ? AND stop_index = ?`,
+		arrivedAt, stop.RideID, stop.StopIndex,
+	); err != nil {
+		return err
+	}
+	stop.ArrivedAt = sql.NullTime{Time: arrivedAt, Valid: true}
+	return nil
+}
+
+// まだ到着していない最初の経由地。すべて回っていれば nil
+func nextRideStop(stops []RideStop) *RideStop {
+	for i := range stops {
+		if !stops[i].ArrivedAt.Valid {
+			return &stops[i]
+		}
+	}
+	return nil
+}
+
+var errRideStopsRemaining = errors.New("chair has not visited all stops yet")
+
+type rideStopResponse struct {
+	Coordinate
+	ArrivedAt *int64 `json:"arrived_at,omitempty"`
+}
+
+func newRideStopResponses(stops []RideStop) []rideStopResponse {
+	res := make([]rideStopResponse, 0, len(stops))
+	for _, s := range stops {
+		r := rideStopResponse{Coordinate: Coordinate{Latitude: s.Latitude, Longitude: s.Longitude}}
+		if s.ArrivedAt.Valid {
+			t := s.ArrivedAt.Time.UnixMilli()
+			r.ArrivedAt = &t
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+type rideLegResponse struct {
+	From      Coordinate `json:"from"`
+	To        Coordinate `json:"to"`
+	Distance  int        `json:"distance"`
+	ArrivedAt *int64     `json:"arrived_at,omitempty"`
+}
+
+// 配車位置から経由地を経て目的地までの区間を返す
+// 最後の区間の到着日時は arrivedAt (ARRIVED になった日時) を使う
+func newRideLegResponses(ride Ride, stops []RideStop, arrivedAt *int64) []rideLegResponse {
+	legs := []rideLegResponse{}
+	from := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	for _, s := range newRideStopResponses(stops) {
+		legs = append(legs, rideLegResponse{
+			From:      from,
+			To:        s.Coordinate,
+			Distance:  calculateDistance(from.Latitude, from.Longitude, s.Latitude, s.Longitude),
+			ArrivedAt: s.ArrivedAt,
+		})
+		from = s.Coordinate
+	}
+	to := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	legs = append(legs, rideLegResponse{
+		From:      from,
+		To:        to,
+		Distance:  calculateDistance(from.Latitude, from.Longitude, to.Latitude, to.Longitude),
+		ArrivedAt: arrivedAt,
+	})
+	return legs
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/motoki317/sc"
+)
+
+// chair_models の速度で分けた椅子のティア
+const (
+	chairTierStandard = "standard"
+	chairTierComfort  = "comfort"
+	chairTierPremium  = "premium"
+)
+
+var chairTiers = []string{chairTierStandard, chairTierComfort, chairTierPremium}
+
+func chairTierForSpeed(speed int) string {
+	switch {
+	case speed <= 2:
+		return chairTierStandard
+	case speed <= 3:
+		return chairTierComfort
+	default:
+		return chairTierPremium
+	}
+}
+
+func isValidChairTier(tier string) bool {
+	for _, t := range chairTiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
+
+// ティアごとの距離料金の割増率(%)。ティアを指定しないライドは standard と同じ
+func chairTierFarePercent(tier string) int {
+	switch tier {
+	case chairTierComfort:
+		return 125
+	case chairTierPremium:
+		return 150
+	default:
+		return 100
+	}
+}
+
+// 希望したティアの椅子が見つからないまま待つ時間。過ぎたらほかのティアの椅子も割り当てる
+var tierFallbackWait = func() time.Duration {
+	seconds := 30
+	if vStr, exists := os.LookupEnv("ISUCON_TIER_FALLBACK_SECONDS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil && val >= 0 {
+			seconds = val
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}()
+
+// モデル名からティアを引く
+var chairModelTiersCache, _ = sc.New(func(ctx context.Context, _ struct{}) (map[string]string, error) {
+	models := []ChairModel{}
+	if err := ridesDatabase().SelectContext(ctx, &models, "SELECT * FROM chair_models"); err != nil {
+		return nil, err
+	}
+	tiers := make(map[string]string, len(models))
+	for _, m := range models {
+		tiers[m.Name] = chairTierForSpeed(m.Speed)
+	}
+	return tiers, nil
+}, 5*time.Minute, 5*time.Minute)
+
+// 登録されている椅子のモデル。椅子のいないモデルを指定したライドはいつまでもマッチしない
+var registeredChairModelsCache, _ = sc.New(func(ctx context.Context, _ struct{}) (map[string]bool, error) {
+	models := []string{}
+	if err := ridesDatabase().SelectContext(ctx, &models, "SELECT DISTINCT model FROM chairs WHERE deleted_at IS NULL"); err != nil {
+		return nil, err
+	}
+	registered := make(map[string]bool, len(models))
+	for _, m := range models {
+		registered[m] = true
+	}
+	return registered, nil
+}, 5*time.Second, 5*time.Second)
+
+var errInvalidTierPreference = errors.New("invalid tier preference")
+
+// ティアかモデルのどちらかで指定された希望を検証し、料金の基準にするティアを返す
+// モデルで指定した場合はその中で最も高いティアの料金になる
+func resolveRideTier(ctx context.Context, tier string, models []string) (string, error) {
+	if tier != "" && len(models) > 0 {
+		return "", errInvalidTierPreference
+	}
+	if tier != "" {
+		if !isValidChairTier(tier) {
+			return "", errInvalidTierPreference
+		}
+		return tier, nil
+	}
+	if len(models) == 0 {
+		return "", nil
+	}
+	tiers, err := chairModelTiersCache.Get(ctx, struct{}{})
+	if err != nil {
+		return "", err
+	}
+	registered, err := registeredChairModelsCache.Get(ctx, struct{}{})
+	if err != nil {
+		return "", err
+	}
+	resolved := ""
+	for _, m := range models {
+		t, ok := tiers[m]
+		if !ok {
+			return "", errInvalidTierPreference
+		}
+		if !registered[m] {
+			return "", fmt.Errorf("%w: no chairs of model %s are registered", errInvalidTierPreference, m)
+		}
+		if resolved == "" || chairTierFarePercent(t) > chairTierFarePercent(resolved) {
+			resolved = t
+		}
+	}
+	return resolved, nil
+}
+
+func insertRideRequestedModels(ctx context.Context, ridesTx *sqlx.Tx, rideID string, models []string) error {
+	for _, m := range models {
+		if _, err := ridesTx.ExecContext(ctx, "INSERT IGNORE INTO ride_requested_models (ride_id, model) VALUES (?, ?)", rideID, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ライドを担当できる椅子のモデル。nil ならどのモデルでもよい
+// 待ち時間が tierFallbackWait を過ぎ、乗客がほかのティアを許可していれば制限しない
+func allowedModelsForRide(ctx context.Context, ride *Ride, now time.Time) (map[string]bool, error) {
+	if ride.Tier == nil {
+		return nil, nil
+	}
+	if ride.AllowTierFallback && now.Sub(ride.CreatedAt) >= tierFallbackWait {
+		return nil, nil
+	}
+
+	requested := []string{}
+	if err := ridesDatabase().SelectContext(ctx, &requested, "SELECT model FROM ride_requested_models WHERE ride_id = ?", ride.ID); err != nil {
+		return nil, err
+	}
+	allowed := map[string]bool{}
+	if len(requested) > 0 {
+		for _, m := range requested {
+			allowed[m] = true
+		}
+		return allowed, nil
+	}
+
+	tiers, err := chairModelTiersCache.Get(ctx, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	for model, tier := range tiers {
+		if tier == *ride.Tier {
+			allowed[model] = true
+		}
+	}
+	return allowed, nil
+}
+
+// ほかのティアの椅子を割り当てた場合、そのティアの方が安ければ料金をそちらに合わせる
+func adjustRideTierToChair(ctx context.Context, ride *Ride, chairID string) error {
+	if ride.Tier == nil {
+		return nil
+	}
+	var model string
+	if err := ridesDatabase().GetContext(ctx, &model, "SELECT model FROM chairs WHERE id = ?", chairID); err != nil {
+		return err
+	}
+	tiers, err := chairModelTiersCache.Get(ctx, struct{}{})
+	if err != nil {
+		return err
+	}
+	served, ok := tiers[model]
+	if !ok || chairTierFarePercent(served) >= chairTierFarePercent(*ride.Tier) {
+		return nil
+	}
+	_, err = ridesDatabase().ExecContext(ctx, "UPDATE rides SET tier = ? WHERE id = ?", served, ride.ID)
+	return err
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+type RideTracePoint struct {
+	ID        string    `db:"id"`
+	RideID    string    `db:"ride_id"`
+	ChairID   string    `db:"chair_id"`
+	Status    string    `db:"status"`
+	Latitude  int       `db:"latitude"`
+	Longitude int       `db:"longitude"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type RideTrace struct {
+	RideID     string    `db:"ride_id"`
+	Status     string    `db:"status"`
+	ChairID    string    `db:"chair_id"`
+	Polyline   string    `db:"polyline"`
+	PointCount int       `db:"point_count"`
+	StartedAt  time.Time `db:"started_at"`
+	EndedAt    time.Time `db:"ended_at"`
+}
+
+// 軌跡を保持する期間。過ぎたものは圧縮済みのものも含めて消す
+var traceRetention = func() time.Duration {
+	hours := 24 * 30
+	if vStr, exists := os.LookupEnv("ISUCON_TRACE_RETENTION_HOURS"); exists {
+		if val, err := strconv.Atoi(vStr); err == nil {
+			hours = val
+		}
+	}
+	return time.Duration(hours) * time.Hour
+}()
+
+func isTracedRideStatus(status string) bool {
+	return status == "ENROUTE" || status == "CARRYING"
+}
+
+func appendRideTracePoint(ctx context.Context, ridesTx *sqlx.Tx, rideID, chairID, status string, latitude, longitude int, recordedAt time.Time) error {
+	_, err := ridesTx.ExecContext(
+		ctx,
+		`INSERT INTO ride_trace_points (id, ride_id, chair_id, status, latitude, longitude, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ulid.Make().String(), rideID, chairID, status, latitude, longitude, recordedAt,
+	)
+	return err
+}
+
+type rideTraceSegment struct {
+	Status    string       `json:"status"`
+	Polyline  string       `json:"polyline"`
+	Points    []Coordinate `json:"points"`
+	StartedAt int64        `json:"started_at"`
+	EndedAt   int64        `json:"ended_at"`
+}
+
+// ライドの軌跡を状態ごとに返す。圧縮済みならそれを、まだなら生の座標を使う
+func getRideTraceSegments(ctx context.Context, rideID string) ([]rideTraceSegment, error) {
+	segments := []rideTraceSegment{}
+
+	traces := []RideTrace{}
+	if err := ridesDatabase().SelectContext(ctx, &traces, `SELECT * FROM ride_traces WHERE ride_id = ? ORDER BY started_at`, rideID); err != nil {
+		return nil, err
+	}
+	if len(traces) > 0 {
+		for _, trace := range traces {
+			points, err := decodePolyline(trace.Polyline)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, rideTraceSegment{
+				Status:    trace.Status,
+				Polyline:  trace.Polyline,
+				Points:    points,
+				StartedAt: trace.StartedAt.UnixMilli(),
+				EndedAt:   trace.EndedAt.UnixMilli(),
+			})
+		}
+		return segments, nil
+	}
+
+	points := []RideTracePoint{}
+	if err := ridesDatabase().SelectContext(ctx, &points, `SELECT * FROM ride_trace_points WHERE ride_id = ? ORDER BY created_at, id`, rideID); err != nil {
+		return nil, err
+	}
+	for _, trace := range buildRideTraces(points) {
+		segments = append(segments, rideTraceSegment{
+			Status:    trace.Status,
+			Polyline:  trace.Polyline,
+			Points:    pointsToCoordinates(points, trace.Status),
+			StartedAt: trace.StartedAt.UnixMilli(),
+			EndedAt:   trace.EndedAt.UnixMilli(),
+		})
+	}
+	return segments, nil
+}
+
+func pointsToCoordinates(points []RideTracePoint, status string) []Coordinate {
+	coordinates := []Coordinate{}
+	for _, p := range points {
+		if p.Status == status {
+			coordinates = append(coordinates, Coordinate{Latitude: p.Latitude, Longitude: p.Longitude})
+		}
+	}
+	return coordinates
+}
+
+// 記録順に並んだ座標を状態ごとの圧縮済み軌跡にまとめる
+func buildRideTraces(points []RideTracePoint) []RideTrace {
+	traces := []RideTrace{}
+	indexByStatus := map[string]int{}
+	coordinatesByStatus := map[string][]Coordinate{}
+	for _, p := range points {
+		i, ok := indexByStatus[p.Status]
+		if !ok {
+			i = len(traces)
+			indexByStatus[p.Status] = i
+			traces = append(traces, RideTrace{
+				RideID:    p.RideID,
+				Status:    p.Status,
+				ChairID:   p.ChairID,
+				StartedAt: p.CreatedAt,
+			})
+		}
+		traces[i].PointCount++
+		traces[i].EndedAt = p.CreatedAt
+		coordinatesByStatus[p.Status] = append(coordinatesByStatus[p.Status], Coordinate{Latitude: p.Latitude, Longitude: p.Longitude})
+	}
+	for i := range traces {
+		traces[i].Polyline = encodePolyline(coordinatesByStatus[traces[i].Status])
+	}
+	return traces
+}
+
+// 完了したライドの座標を圧縮し、保持期間を過ぎた軌跡を消す
+func compactRideTraces(ctx context.Context) error {
+	rideIDs := []string{}
+	if err := ridesDatabase().SelectContext(
+		ctx,
+		&rideIDs,
+		`SELECT DISTINCT ride_trace_points.ride_id
+			FROM ride_trace_points
+			JOIN ride_statuses ON ride_statuses.ride_id = ride_trace_points.ride_id AND ride_statuses.status = 'COMPLETED'
+			LIMIT 100`,
+	); err != nil {
+		return err
+	}
+
+	for _, rideID := range rideIDs {
+		if err := compactRideTrace(ctx, rideID); err != nil {
+			return err
+		}
+	}
+
+	expiredBefore := time.Now().Add(-traceRetention)
+	if _, err := ridesDatabase().ExecContext(ctx, `DELETE FROM ride_traces WHERE ended_at < ?`, expiredBefore); err != nil {
+		return err
+	}
+	// 完了しないまま残った座標も保持期間で消す
+	if _, err := ridesDatabase().ExecContext(ctx, `DELETE FROM ride_trace_points WHERE created_at < ?`, expiredBefore); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func compactRideTrace(ctx context.Context, rideID string) error {
+	tx, err := ridesDatabase().Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	points := []RideTracePoint{}
+	if err := tx.SelectContext(ctx, &points, `SELECT * FROM ride_trace_points WHERE ride_id = ? ORDER BY created_at, id FOR UPDATE`, rideID); err != nil {
+		return err
+	}
+	for _, trace := range buildRideTraces(points) {
+		if _, err := tx.NamedExecContext(
+			ctx,
+			`INSERT INTO ride_traces (ride_id, status, chair_id, polyline, point_count, started_at, ended_at)
+				VALUES (:ride_id, :status, :chair_id, :polyline, :point_count, :started_at, :ended_at)`,
+			trace,
+		); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM ride_trace_points WHERE ride_id = ?`, rideID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func startRideTraceCompaction() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := compactRideTraces(context.Background()); err != nil {
+			slog.Error("Failed to compact ride traces", "err", err)
+		}
+	}
+}
+
+// 座標列を Encoded Polyline Algorithm Format で文字列にする
+// 座標は整数なのでスケーリングせずに差分をそのまま符号化する
+func encodePolyline(coordinates []Coordinate) string {
+	var sb strings.Builder
+	prevLatitude, prevLongitude := 0, 0
+	for _, c := range coordinates {
+		writePolylineValue(&sb, c.Latitude-prevLatitude)
+		writePolylineValue(&sb, c.Longitude-prevLongitude)
+		prevLatitude, prevLongitude = c.Latitude, c.Longitude
+	}
+	return sb.String()
+}
+
+func writePolylineValue(sb *strings.Builder, v int) {
+	u := v << 1
+	if v < 0 {
+		u = ^u
+	}
+	for u >= 0x20 {
+		sb.WriteByte(byte((0x20 | (u & 0x1f)) + 63))
+		u >>= 5
+	}
+	sb.WriteByte(byte(u + 63))
+}
+
+var errInvalidPolyline = errors.New("invalid polyline")
+
+func decodePolyline(s string) ([]Coordinate, error) {
+	coordinates := []Coordinate{}
+	latitude, longitude := 0, 0
+	for i := 0; i < len(s); {
+		dLatitude, n, err := readPolylineValue(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		dLongitude, n, err := readPolylineValue(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		latitude += dLatitude
+		longitude += dLongitude
+		coordinates = append(coordinates, Coordinate{Latitude: latitude, Longitude: longitude})
+	}
+	return coordinates, nil
+}
+
+func readPolylineValue(s string) (int, int, error) {
+	u, shift := 0, 0
+	for i := 0; i < len(s); i++ {
+		b := int(s[i]) - 63
+		if b < 0 || shift > 60 {
+			return 0, 0, errInvalidPolyline
+		}
+		u |= (b & 0x1f) << shift
+		shift += 5
+		if b < 0x20 {
+			v := u >> 1
+			if u&1 != 0 {
+				v = ^v
+			}
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errInvalidPolyline
+}
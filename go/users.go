@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 登録時と更新時で共通の検証
+func validateUserProfile(username, firstname, lastname, dateOfBirth string) error {
+	if username == "" || firstname == "" || lastname == "" || dateOfBirth == "" {
+		return errors.New("required fields(username, firstname, lastname, date_of_birth) are empty")
+	}
+	return nil
+}
+
+// 利用者の情報を変えたら、どのキーで引いたキャッシュも古くなる
+func forgetUserCaches(user *User) {
+	userByIDCache.Forget(user.ID)
+	userByInviteCache.Forget(user.InvitationCode)
+}
+
+type appGetMeResponse struct {
+	ID             string `json:"id"`
+	Username       string `json:"username"`
+	FirstName      string `json:"firstname"`
+	LastName       string `json:"lastname"`
+	DateOfBirth    string `json:"date_of_birth"`
+	InvitationCode string `json:"invitation_code"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+func newAppGetMeResponse(user *User) *appGetMeResponse {
+	return &appGetMeResponse{
+		ID:             user.ID,
+		Username:       user.Username,
+		FirstName:      user.Firstname,
+		LastName:       user.Lastname,
+		DateOfBirth:    user.DateOfBirth,
+		InvitationCode: user.InvitationCode,
+		CreatedAt:      user.CreatedAt.UnixMilli(),
+	}
+}
+
+func appGetMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	writeJSON(w, http.StatusOK, newAppGetMeResponse(user))
+}
+
+// 指定した項目だけを更新する
+type appPatchMeRequest struct {
+	Username    *string `json:"username"`
+	FirstName   *string `json:"firstname"`
+	LastName    *string `json:"lastname"`
+	DateOfBirth *string `json:"date_of_birth"`
+}
+
+func appPatchMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	req := &appPatchMeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	updated := *user
+	if req.Username != nil {
+		updated.Username = *req.Username
+	}
+	if req.FirstName != nil {
+		updated.Firstname = *req.FirstName
+	}
+	if req.LastName != nil {
+		updated.Lastname = *req.LastName
+	}
+	if req.DateOfBirth != nil {
+		updated.DateOfBirth = *req.DateOfBirth
+	}
+	if err := validateUserProfile(updated.Username, updated.Firstname, updated.Lastname, updated.DateOfBirth); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := database().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if updated.Username != user.Username {
+		var taken bool
+		if err := tx.GetContext(ctx, &taken, "SELECT EXISTS (SELECT 1 FROM users WHERE username = ? AND id != ?)", updated.Username, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if taken {
+			writeError(w, http.StatusConflict, errors.New("username is already taken"))
+			return
+		}
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE users SET username = ?, firstname = ?, lastname = ?, date_of_birth = ? WHERE id = ?",
+		updated.Username, updated.Firstname, updated.Lastname, updated.DateOfBirth, user.ID,
+	); err != nil {
+		if isDuplicateEntryError(err) {
+			writeError(w, http.StatusConflict, errors.New("username is already taken"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	forgetUserCaches(user)
+
+	writeJSON(w, http.StatusOK, newAppGetMeResponse(&updated))
+}
+
+var errUserHasActiveRide = errors.New("user has an active ride")
+
+// 配車の要求と退会が同時に進まないように、どちらも利用者の行をロックしてから確かめる
+func lockActiveUser(ctx context.Context, tx *sqlx.Tx, userID string) error {
+	var id string
+	return tx.GetContext(ctx, &id, "SELECT id FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE", userID)
+}
+
+// 退会した利用者のライドは売上の集計に必要なので残し、個人情報だけを消す
+// セッションを失効させ、招待コードも差し替えて、以降は使えないようにする
+// 完了していないライドがあれば errUserHasActiveRide を返す
+func anonymizeUser(ctx context.Context, user *User) error {
+	tx, err := database().Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockActiveUser(ctx, tx, user.ID); err != nil {
+		return err
+	}
+
+	ridesTx, err := ridesDatabase().Beginx()
+	if err != nil {
+		return err
+	}
+	defer ridesTx.Rollback()
+
+	rides := []Ride{}
+	if err := ridesTx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ?`, user.ID); err != nil {
+		return err
+	}
+	for _, ride := range rides {
+		status, err := getLatestRideStatus(ctx, ridesTx, ride.ID)
+		if err != nil {
+			return err
+		}
+		if status != "COMPLETED" {
+			return errUserHasActiveRide
+		}
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE users SET
+			username = CONCAT('del_', id),
+			firstname = 'deleted',
+			lastname = 'user',
+			date_of_birth = '',
+			access_token = ?,
+			password_hash = NULL,
+			invitation_code = ?,
+			deleted_at = CURRENT_TIMESTAMP(6)
+		WHERE id = ?`,
+		hashSessionToken(secureRandomStr(32)), secureRandomStr(15), user.ID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM payment_tokens WHERE user_id = ?", user.ID); err != nil {
+		return err
+	}
+
+	// 自由記述のコメントにも個人情報が含まれうる
+	if _, err := ridesTx.ExecContext(ctx, "UPDATE ride_reviews SET comment = '' WHERE user_id = ?", user.ID); err != nil {
+		return err
+	}
+
+	// 退会が確定してからコメントを消す
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := ridesTx.Commit(); err != nil {
+		return err
+	}
+
+	if err := revokeSubjectSessions(ctx, sessionKindApp, user.ID); err != nil {
+		return err
+	}
+	forgetUserCaches(user)
+	paymentTokenCache.Forget(user.ID)
+	return nil
+}
+
+func appDeleteMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	if err := anonymizeUser(ctx, user); err != nil {
+		switch {
+		case errors.Is(err, errUserHasActiveRide):
+			writeError(w, http.StatusConflict, err)
+		case errors.Is(err, sql.ErrNoRows):
+			writeError(w, http.StatusNotFound, errors.New("user not found"))
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Path:   "/",
+		Name:   sessionCookieNames[sessionKindApp],
+		MaxAge: -1,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -52,6 +52,29 @@ CREATE TABLE chair_locations
 )
   COMMENT = '椅子の現在位置情報テーブル';
 
+DROP TABLE IF EXISTS chair_suspicious_events;
+CREATE TABLE chair_suspicious_events
+(
+  id               VARCHAR(26) NOT NULL,
+  chair_id         VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  owner_id         VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  kind             VARCHAR(30) NOT NULL COMMENT '検知の種類',
+  action           ENUM ('flagged', 'rejected') NOT NULL COMMENT '受け付けたか拒否したか',
+  from_latitude    INTEGER     NOT NULL COMMENT '直前の経度',
+  from_longitude   INTEGER     NOT NULL COMMENT '直前の緯度',
+  to_latitude      INTEGER     NOT NULL COMMENT '報告された経度',
+  to_longitude     INTEGER     NOT NULL COMMENT '報告された緯度',
+  distance         INTEGER     NOT NULL COMMENT '移動距離',
+  elapsed_ms       BIGINT      NOT NULL COMMENT '経過時間(ミリ秒)',
+  allowed_distance INTEGER     NOT NULL COMMENT '経過時間内に移動できる距離',
+  recorded_at      DATETIME(6) NOT NULL COMMENT '座標の記録日時',
+  created_at       DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  INDEX idx_owner_id_recorded_at (owner_id, recorded_at),
+  INDEX idx_chair_id_recorded_at (chair_id, recorded_at)
+)
+  COMMENT = '椅子の不自然な移動の記録テーブル';
+
 DROP TABLE IF EXISTS users;
 CREATE TABLE users
 (
@@ -71,6 +94,50 @@ CREATE TABLE users
 )
   COMMENT = '利用者情報テーブル';
 
+DROP TABLE IF EXISTS sessions;
+CREATE TABLE sessions
+(
+  id         VARCHAR(26)                       NOT NULL COMMENT 'セッションID',
+  token_hash CHAR(64)                          NOT NULL COMMENT 'トークンのSHA-256',
+  kind       ENUM ('app', 'owner', 'chair')    NOT NULL COMMENT '利用者・オーナー・椅子のどれのセッションか',
+  subject_id VARCHAR(26)                       NOT NULL COMMENT '利用者・オーナー・椅子のID',
+  user_agent VARCHAR(255)                      NOT NULL DEFAULT '' COMMENT '発行時のUser-Agent',
+  created_at DATETIME(6)                       NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  expires_at DATETIME(6)                       NULL     COMMENT '有効期限。NULLなら無期限',
+  revoked_at DATETIME(6)                       NULL     COMMENT '失効日時',
+  PRIMARY KEY (id),
+  UNIQUE INDEX idx_token_hash (token_hash),
+  INDEX idx_kind_subject_id (kind, subject_id)
+)
+  COMMENT = 'セッションテーブル';
+
+DROP TABLE IF EXISTS login_codes;
+CREATE TABLE login_codes
+(
+  id         VARCHAR(26)             NOT NULL COMMENT 'ログインコードID',
+  kind       ENUM ('app', 'owner')   NOT NULL COMMENT '利用者・オーナーのどちらのログインか',
+  subject_id VARCHAR(26)             NOT NULL COMMENT '利用者・オーナーのID',
+  code_hash  CHAR(64)                NOT NULL COMMENT 'コードのSHA-256',
+  created_at DATETIME(6)             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  expires_at DATETIME(6)             NOT NULL COMMENT '有効期限',
+  used_at    DATETIME(6)             NULL     COMMENT '使用日時',
+  PRIMARY KEY (id),
+  INDEX idx_kind_subject_id (kind, subject_id)
+)
+  COMMENT = 'ワンタイムログインコードテーブル';
+
+DROP TABLE IF EXISTS login_failures;
+CREATE TABLE login_failures
+(
+  id         BIGINT                  NOT NULL AUTO_INCREMENT,
+  kind       ENUM ('app', 'owner')   NOT NULL COMMENT '利用者・オーナーのどちらのログインか',
+  identifier VARCHAR(255)            NOT NULL COMMENT '入力されたユーザー名・オーナー名',
+  created_at DATETIME(6)             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '失敗日時',
+  PRIMARY KEY (id),
+  INDEX idx_kind_identifier_created_at (kind, identifier, created_at)
+)
+  COMMENT = 'ログイン失敗の記録テーブル';
+
 DROP TABLE IF EXISTS payment_tokens;
 CREATE TABLE payment_tokens
 (
@@ -96,6 +163,7 @@ CREATE TABLE rides
   updated_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '状態更新日時',
   PRIMARY KEY (id),
   INDEX idx_user_id_created_at (user_id, created_at DESC),
+  INDEX idx_user_id_id (user_id, id DESC),
   INDEX idx_chair_id_updated_at (chair_id, updated_at DESC)
 )
   COMMENT = 'ライド情報テーブル';
@@ -114,6 +182,252 @@ CREATE TABLE ride_statuses
 )
   COMMENT = 'ライドステータスの変更履歴テーブル';
 
+DROP TABLE IF EXISTS ride_stops;
+CREATE TABLE ride_stops
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  stop_index INTEGER     NOT NULL COMMENT '経由する順番(1始まり)',
+  latitude   INTEGER     NOT NULL COMMENT '経由地 経度',
+  longitude  INTEGER     NOT NULL COMMENT '経由地 緯度',
+  arrived_at DATETIME(6) NULL     COMMENT '経由地に到着した日時',
+  PRIMARY KEY (ride_id, stop_index)
+)
+  COMMENT = 'ライドの経由地テーブル';
+
+DROP TABLE IF EXISTS ride_requested_models;
+CREATE TABLE ride_requested_models
+(
+  ride_id VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  model   VARCHAR(50) NOT NULL COMMENT '希望する椅子モデル名',
+  PRIMARY KEY (ride_id, model)
+)
+  COMMENT = 'ライドで希望された椅子モデルテーブル';
+
+DROP TABLE IF EXISTS chair_pool_routes;
+CREATE TABLE chair_pool_routes
+(
+  chair_id  VARCHAR(26)               NOT NULL COMMENT '椅子ID',
+  seq       INTEGER                   NOT NULL COMMENT '回る順番(1始まり)',
+  ride_id   VARCHAR(26)               NOT NULL COMMENT 'ライドID',
+  kind      ENUM ('pickup', 'dropoff') NOT NULL COMMENT '乗車か降車か',
+  latitude  INTEGER                   NOT NULL COMMENT '経度',
+  longitude INTEGER                   NOT NULL COMMENT '緯度',
+  PRIMARY KEY (chair_id, seq)
+)
+  COMMENT = '相乗りの椅子が回る順番テーブル';
+
+DROP TABLE IF EXISTS ride_payments;
+CREATE TABLE ride_payments
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  reference  VARCHAR(26) NOT NULL COMMENT '支払い番号',
+  amount     INTEGER     NOT NULL COMMENT '請求額',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '支払い日時',
+  PRIMARY KEY (ride_id),
+  UNIQUE INDEX idx_reference (reference)
+)
+  COMMENT = 'ライドの支払いテーブル';
+
+DROP TABLE IF EXISTS ride_reviews;
+CREATE TABLE ride_reviews
+(
+  ride_id           VARCHAR(26)                                NOT NULL COMMENT 'ライドID',
+  chair_id          VARCHAR(26)                                NOT NULL COMMENT '椅子ID',
+  user_id           VARCHAR(26)                                NOT NULL COMMENT '利用者ID',
+  comment           TEXT                                       NOT NULL COMMENT 'コメント',
+  moderation_status ENUM ('pending', 'approved', 'rejected')   NOT NULL COMMENT 'コメントの審査状態',
+  created_at        DATETIME(6)                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '投稿日時',
+  updated_at        DATETIME(6)                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id),
+  INDEX idx_chair_id_created_at (chair_id, created_at DESC),
+  INDEX idx_moderation_status (moderation_status)
+)
+  COMMENT = 'ライドのレビューテーブル';
+
+DROP TABLE IF EXISTS ride_review_tags;
+CREATE TABLE ride_review_tags
+(
+  ride_id VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  tag     VARCHAR(30) NOT NULL COMMENT 'タグ',
+  PRIMARY KEY (ride_id, tag)
+)
+  COMMENT = 'ライドのレビューに付けたタグテーブル';
+
+DROP TABLE IF EXISTS rider_ratings;
+CREATE TABLE rider_ratings
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  user_id    VARCHAR(26) NOT NULL COMMENT '評価された利用者ID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '評価した椅子ID',
+  rating     INTEGER     NOT NULL COMMENT '評価(1〜5)',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '評価日時',
+  PRIMARY KEY (ride_id),
+  INDEX idx_user_id (user_id)
+)
+  COMMENT = '椅子による利用者の評価テーブル';
+
+DROP TABLE IF EXISTS rider_rating_tags;
+CREATE TABLE rider_rating_tags
+(
+  ride_id VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  tag     VARCHAR(30) NOT NULL COMMENT 'タグ',
+  PRIMARY KEY (ride_id, tag)
+)
+  COMMENT = '椅子による利用者の評価に付けたタグテーブル';
+
+DROP TABLE IF EXISTS ride_metrics;
+CREATE TABLE ride_metrics
+(
+  ride_id           VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  pickup_distance   INTEGER     NOT NULL DEFAULT 0 COMMENT '配車位置までの移動距離',
+  carrying_distance INTEGER     NOT NULL DEFAULT 0 COMMENT '乗車中の移動距離',
+  wait_time_ms      BIGINT      NOT NULL DEFAULT 0 COMMENT 'マッチングから出発までの時間(ミリ秒)',
+  pickup_time_ms    BIGINT      NOT NULL DEFAULT 0 COMMENT '出発から配車位置到着までの時間(ミリ秒)',
+  trip_time_ms      BIGINT      NOT NULL DEFAULT 0 COMMENT '乗車から目的地到着までの時間(ミリ秒)',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドごとの移動距離・所要時間テーブル';
+
+DROP TABLE IF EXISTS ride_trace_points;
+CREATE TABLE ride_trace_points
+(
+  id         VARCHAR(26)                 NOT NULL,
+  ride_id    VARCHAR(26)                 NOT NULL COMMENT 'ライドID',
+  chair_id   VARCHAR(26)                 NOT NULL COMMENT '椅子ID',
+  status     ENUM ('ENROUTE', 'CARRYING') NOT NULL COMMENT '記録時のライドの状態',
+  latitude   INTEGER                     NOT NULL COMMENT '経度',
+  longitude  INTEGER                     NOT NULL COMMENT '緯度',
+  created_at DATETIME(6)                 NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '記録日時',
+  PRIMARY KEY (id),
+  INDEX idx_ride_id_created_at (ride_id, created_at),
+  INDEX idx_created_at (created_at)
+)
+  COMMENT = 'ライド中の椅子の移動軌跡(圧縮前)テーブル';
+
+DROP TABLE IF EXISTS ride_traces;
+CREATE TABLE ride_traces
+(
+  ride_id     VARCHAR(26)                 NOT NULL COMMENT 'ライドID',
+  status      ENUM ('ENROUTE', 'CARRYING') NOT NULL COMMENT 'ライドの状態',
+  chair_id    VARCHAR(26)                 NOT NULL COMMENT '椅子ID',
+  polyline    TEXT                        NOT NULL COMMENT 'エンコード済みの座標列',
+  point_count INTEGER                     NOT NULL COMMENT '座標数',
+  started_at  DATETIME(6)                 NOT NULL COMMENT '最初の座標の記録日時',
+  ended_at    DATETIME(6)                 NOT NULL COMMENT '最後の座標の記録日時',
+  PRIMARY KEY (ride_id, status),
+  INDEX idx_ended_at (ended_at)
+)
+  COMMENT = 'ライド中の椅子の移動軌跡(圧縮済み)テーブル';
+
+DROP TABLE IF EXISTS chair_ownerships;
+CREATE TABLE chair_ownerships
+(
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  owner_id   VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  started_at DATETIME(6) NOT NULL COMMENT '所有を始めた日時',
+  PRIMARY KEY (chair_id, started_at)
+)
+  COMMENT = '椅子の所有者の履歴テーブル(譲渡された椅子だけ)';
+
+DROP TABLE IF EXISTS chair_sales_hourly;
+CREATE TABLE chair_sales_hourly
+(
+  chair_id          VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  owner_id          VARCHAR(26) NOT NULL COMMENT '売上を計上したオーナーID',
+  hour              DATETIME    NOT NULL COMMENT '集計時間帯(時単位)',
+  sales             INTEGER     NOT NULL DEFAULT 0 COMMENT '売上',
+  ride_count        INTEGER     NOT NULL DEFAULT 0 COMMENT '完了ライド数',
+  evaluation_sum    INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  pickup_distance   INTEGER     NOT NULL DEFAULT 0 COMMENT '配車位置までの移動距離の合計',
+  carrying_distance INTEGER     NOT NULL DEFAULT 0 COMMENT '乗車中の移動距離の合計',
+  wait_time_ms      BIGINT      NOT NULL DEFAULT 0 COMMENT '待ち時間の合計(ミリ秒)',
+  pickup_time_ms    BIGINT      NOT NULL DEFAULT 0 COMMENT '迎車時間の合計(ミリ秒)',
+  trip_time_ms      BIGINT      NOT NULL DEFAULT 0 COMMENT '乗車時間の合計(ミリ秒)',
+  PRIMARY KEY (chair_id, owner_id, hour),
+  INDEX idx_owner_id_hour (owner_id, hour)
+)
+  COMMENT = '椅子ごとの時間別売上集計テーブル';
+
+DROP TABLE IF EXISTS chair_sales_daily;
+CREATE TABLE chair_sales_daily
+(
+  chair_id          VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  owner_id          VARCHAR(26) NOT NULL COMMENT '売上を計上したオーナーID',
+  day               DATE        NOT NULL COMMENT '集計日',
+  sales             INTEGER     NOT NULL DEFAULT 0 COMMENT '売上',
+  ride_count        INTEGER     NOT NULL DEFAULT 0 COMMENT '完了ライド数',
+  evaluation_sum    INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  pickup_distance   INTEGER     NOT NULL DEFAULT 0 COMMENT '配車位置までの移動距離の合計',
+  carrying_distance INTEGER     NOT NULL DEFAULT 0 COMMENT '乗車中の移動距離の合計',
+  wait_time_ms      BIGINT      NOT NULL DEFAULT 0 COMMENT '待ち時間の合計(ミリ秒)',
+  pickup_time_ms    BIGINT      NOT NULL DEFAULT 0 COMMENT '迎車時間の合計(ミリ秒)',
+  trip_time_ms      BIGINT      NOT NULL DEFAULT 0 COMMENT '乗車時間の合計(ミリ秒)',
+  PRIMARY KEY (chair_id, owner_id, day),
+  INDEX idx_owner_id_day (owner_id, day)
+)
+  COMMENT = '椅子ごとの日別売上集計テーブル';
+
+DROP TABLE IF EXISTS chair_stats;
+CREATE TABLE chair_stats
+(
+  chair_id       VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  ride_count     INTEGER     NOT NULL DEFAULT 0 COMMENT '評価済みの完了ライド数',
+  evaluation_sum INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  updated_at     DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '椅子ごとの通算成績テーブル';
+
+DROP TABLE IF EXISTS service_areas;
+CREATE TABLE service_areas
+(
+  id         VARCHAR(26)                    NOT NULL,
+  name       VARCHAR(50)                    NOT NULL COMMENT 'エリア名',
+  kind       ENUM ('service', 'exclusion')  NOT NULL COMMENT '営業エリアか営業対象外エリアか',
+  vertices   TEXT                           NOT NULL COMMENT '多角形の頂点(JSON)',
+  created_at DATETIME(6)                    NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'サービスエリアテーブル';
+
+DROP TABLE IF EXISTS chair_service_areas;
+CREATE TABLE chair_service_areas
+(
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  area_id    VARCHAR(26) NOT NULL COMMENT 'サービスエリアID',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (chair_id, area_id),
+  INDEX idx_area_id (area_id)
+)
+  COMMENT = '椅子の営業エリアテーブル';
+
+DROP TABLE IF EXISTS chair_schedules;
+CREATE TABLE chair_schedules
+(
+  id           VARCHAR(26) NOT NULL,
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  day_of_week  TINYINT     NOT NULL COMMENT '曜日(日曜が0)',
+  start_minute INTEGER     NOT NULL COMMENT '開始時刻(UTC 0時からの分)',
+  end_minute   INTEGER     NOT NULL COMMENT '終了時刻(UTC 0時からの分)',
+  created_at   DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  INDEX idx_chair_id (chair_id)
+)
+  COMMENT = '椅子の週間稼働予定テーブル';
+
+DROP TABLE IF EXISTS chair_activity_logs;
+CREATE TABLE chair_activity_logs
+(
+  id         VARCHAR(26) NOT NULL,
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  is_active  TINYINT(1)  NOT NULL COMMENT '変更後の稼働状態',
+  reason     VARCHAR(20) NOT NULL COMMENT '変更の理由',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '変更日時',
+  PRIMARY KEY (id),
+  INDEX idx_chair_id_created_at (chair_id, created_at)
+)
+  COMMENT = '椅子の稼働状態の変更履歴テーブル';
+
 DROP TABLE IF EXISTS owners;
 CREATE TABLE owners
 (
@@ -130,6 +444,23 @@ CREATE TABLE owners
 )
   COMMENT = '椅子のオーナー情報テーブル';
 
+DROP TABLE IF EXISTS chair_register_tokens;
+CREATE TABLE chair_register_tokens
+(
+  id         VARCHAR(26)  NOT NULL COMMENT 'トークンID',
+  owner_id   VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  token      VARCHAR(255) NOT NULL COMMENT '椅子登録トークン',
+  max_uses   INTEGER      NULL COMMENT '使用回数の上限',
+  used_count INTEGER      NOT NULL DEFAULT 0 COMMENT '使用回数',
+  expires_at DATETIME(6)  NULL COMMENT '有効期限',
+  revoked_at DATETIME(6)  NULL COMMENT '失効日時',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  PRIMARY KEY (id),
+  UNIQUE (token),
+  INDEX idx_owner_id (owner_id)
+)
+  COMMENT = '椅子登録トークンテーブル';
+
 DROP TABLE IF EXISTS coupons;
 CREATE TABLE coupons
 (
@@ -0,0 +1,3 @@
+ALTER TABLE rides
+  ADD COLUMN tier                VARCHAR(20) NULL              COMMENT '希望した椅子のティア(料金の基準)',
+  ADD COLUMN allow_tier_fallback TINYINT(1)  NOT NULL DEFAULT FALSE COMMENT '希望のティアが見つからないときにほかのティアを許可するか';
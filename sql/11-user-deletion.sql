@@ -0,0 +1,2 @@
+ALTER TABLE users
+  ADD COLUMN deleted_at DATETIME(6) DEFAULT NULL COMMENT '退会日時';
@@ -0,0 +1,5 @@
+ALTER TABLE users
+  ADD COLUMN password_hash VARCHAR(255) DEFAULT NULL COMMENT 'パスワードのbcryptハッシュ';
+
+ALTER TABLE owners
+  ADD COLUMN password_hash VARCHAR(255) DEFAULT NULL COMMENT 'パスワードのbcryptハッシュ';
@@ -0,0 +1,2 @@
+ALTER TABLE chairs
+  ADD COLUMN deleted_at DATETIME(6) DEFAULT NULL COMMENT '削除日時';
@@ -0,0 +1,11 @@
+-- 既存オーナーの椅子登録トークンを移行する
+-- 両方のDBで同じIDになるように、移行分のトークンIDはオーナーIDを使う
+INSERT INTO chair_register_tokens (id, owner_id, token, created_at)
+SELECT id, id, chair_register_token, created_at
+FROM owners;
+
+ALTER TABLE chairs
+  ADD COLUMN register_token_id VARCHAR(26) DEFAULT NULL COMMENT '登録に使われた椅子登録トークンID',
+  ADD INDEX idx_register_token_id (register_token_id);
+
+UPDATE chairs SET register_token_id = owner_id;
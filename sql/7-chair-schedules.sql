@@ -0,0 +1,2 @@
+ALTER TABLE chairs
+  ADD COLUMN pending_deactivation TINYINT(1) NOT NULL DEFAULT FALSE COMMENT 'ライド完了後に稼働を停止するか';
@@ -0,0 +1,2 @@
+ALTER TABLE rides
+  ADD COLUMN route_distance INTEGER NULL COMMENT '経由地を含む経路の距離(経由地が無い場合はNULL)';
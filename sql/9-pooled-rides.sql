@@ -0,0 +1,2 @@
+ALTER TABLE rides
+  ADD COLUMN pooled TINYINT(1) NOT NULL DEFAULT FALSE COMMENT '相乗りを許可したかどうか';
@@ -42,6 +42,54 @@ mysql -u"$ISUCON_DB_USER" \
 	--port "$ISUCON_DB_PORT" \
 	"$ISUCON_DB_NAME" <4-adddistance.sql
 
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <5-chair-management.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <6-chair-register-tokens.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <7-chair-schedules.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <8-ride-stops.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <9-pooled-rides.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <10-ride-tiers.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <11-user-deletion.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST1" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <12-login-credentials.sql
+
 # HOST2を初期化
 ISUCON_DB_HOST2=${ISUCON_DB_HOST2:-127.0.0.1}
 
@@ -69,3 +117,51 @@ mysql -u"$ISUCON_DB_USER" \
 	--host "$ISUCON_DB_HOST2" \
 	--port "$ISUCON_DB_PORT" \
 	"$ISUCON_DB_NAME" <4-adddistance.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <5-chair-management.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <6-chair-register-tokens.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <7-chair-schedules.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <8-ride-stops.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <9-pooled-rides.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <10-ride-tiers.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <11-user-deletion.sql
+
+mysql -u"$ISUCON_DB_USER" \
+	-p"$ISUCON_DB_PASSWORD" \
+	--host "$ISUCON_DB_HOST2" \
+	--port "$ISUCON_DB_PORT" \
+	"$ISUCON_DB_NAME" <12-login-credentials.sql